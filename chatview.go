@@ -0,0 +1,323 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jroimartin/gocui"
+	"regexp"
+	"sync"
+	"unicode/utf8"
+)
+
+const ChatScrollback = 5000 // lines kept in the chatroom view
+
+// number of resolved keys the chat view remembers
+const resolvedKeys = 1000
+
+const (
+	highlightMatch   = "\x1b[43m"
+	highlightCurrent = "\x1b[7m"
+	resetAttributes  = "\x1b[0m"
+)
+
+var ansiEscape = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// ChatView holds the scrollback of the chatroom view and decides which part of it
+// is visible. The chatroom view does not autoscroll; instead it follows new lines
+// until the user scrolls up, and shows how many lines arrived below since then.
+type ChatView struct {
+	sync.Mutex
+	lines []string
+	// keys[i] names lines[i] so it can be replaced or removed later. Most lines have none
+	keys []string
+	// keys given to Resolve, oldest first, which are ignored from then on
+	resolved []string
+	max      int
+	// number of lines scrolled up from the bottom. 0 follows new lines
+	scroll int
+	// number of lines appended while scrolled up
+	unseen int
+
+	// current search, compiled once for every line it is checked against, and the
+	// indexes of lines matching it, oldest first
+	pattern  *regexp.Regexp
+	matches  []int
+	matchIdx int
+}
+
+func NewChatView(max int) *ChatView {
+	return &ChatView{max: max}
+}
+
+func (cv *ChatView) Append(line string) {
+	cv.Lock()
+	defer cv.Unlock()
+	cv.appendKeyed("", line)
+}
+
+// replaces the line with the given key, or appends it if there is none
+func (cv *ChatView) Put(key, line string) {
+	cv.Lock()
+	defer cv.Unlock()
+	if cv.isResolved(key) {
+		return
+	}
+	if idx := cv.find(key); idx >= 0 {
+		cv.lines[idx] = line
+		cv.findMatches()
+		return
+	}
+	cv.appendKeyed(key, line)
+}
+
+// replaces the line with the given key, if there is one
+func (cv *ChatView) Replace(key, line string) {
+	cv.Lock()
+	defer cv.Unlock()
+	if idx := cv.find(key); idx >= 0 {
+		cv.lines[idx] = line
+		cv.findMatches()
+	}
+}
+
+// replaces the line with the given key for good, or appends it if there is none.
+// Later calls with the key do nothing, so a line that arrives late cannot
+// overwrite the final one
+func (cv *ChatView) Resolve(key, line string) {
+	cv.Lock()
+	defer cv.Unlock()
+	if cv.isResolved(key) {
+		return
+	}
+	cv.resolved = append(cv.resolved, key)
+	if len(cv.resolved) > resolvedKeys {
+		cv.resolved = cv.resolved[1:]
+	}
+	if idx := cv.find(key); idx >= 0 {
+		cv.lines[idx] = line
+		cv.keys[idx] = ""
+		cv.findMatches()
+		return
+	}
+	cv.appendKeyed("", line)
+}
+
+func (cv *ChatView) isResolved(key string) bool {
+	for _, other := range cv.resolved {
+		if other == key {
+			return true
+		}
+	}
+	return false
+}
+
+// removes the line with the given key, if it is still in the scrollback
+func (cv *ChatView) Remove(key string) {
+	cv.Lock()
+	defer cv.Unlock()
+	idx := cv.find(key)
+	if idx < 0 {
+		return
+	}
+	cv.lines = append(cv.lines[:idx], cv.lines[idx+1:]...)
+	cv.keys = append(cv.keys[:idx], cv.keys[idx+1:]...)
+	if cv.scroll > 0 && idx >= len(cv.lines)-cv.scroll {
+		// the line was below the visible part
+		cv.scroll--
+	}
+	cv.clampScroll()
+	cv.findMatches()
+}
+
+func (cv *ChatView) find(key string) int {
+	for idx := len(cv.keys) - 1; idx >= 0; idx-- {
+		if cv.keys[idx] == key {
+			return idx
+		}
+	}
+	return -1
+}
+
+func (cv *ChatView) appendKeyed(key, line string) {
+	cv.lines = append(cv.lines, line)
+	cv.keys = append(cv.keys, key)
+	if len(cv.lines) > cv.max {
+		cv.lines = cv.lines[len(cv.lines)-cv.max:]
+		cv.keys = cv.keys[len(cv.keys)-cv.max:]
+		cv.findMatches()
+	} else if cv.pattern != nil && cv.lineMatches(len(cv.lines)-1) {
+		cv.matches = append(cv.matches, len(cv.lines)-1)
+	}
+	if cv.scroll > 0 {
+		cv.scroll++
+		cv.unseen++
+		cv.clampScroll()
+	}
+}
+
+// scrolls up by n lines, or down if n is negative
+func (cv *ChatView) ScrollBy(n int) {
+	cv.Lock()
+	defer cv.Unlock()
+	cv.scroll += n
+	cv.clampScroll()
+}
+
+func (cv *ChatView) ScrollTop() {
+	cv.Lock()
+	defer cv.Unlock()
+	cv.scroll = len(cv.lines) - 1
+	cv.clampScroll()
+}
+
+func (cv *ChatView) ScrollBottom() {
+	cv.Lock()
+	defer cv.Unlock()
+	cv.scroll = 0
+	cv.clampScroll()
+}
+
+// highlights all lines containing query (case insensitive) and jumps to the most recent.
+// An empty query clears the search. Returns the number of matching lines
+func (cv *ChatView) Search(query string) int {
+	cv.Lock()
+	defer cv.Unlock()
+	cv.pattern = nil
+	if len(query) > 0 {
+		cv.pattern = regexp.MustCompile("(?i)" + regexp.QuoteMeta(query))
+	}
+	cv.findMatches()
+	if len(cv.matches) > 0 {
+		cv.matchIdx = len(cv.matches) - 1
+		cv.showMatch()
+	}
+	return len(cv.matches)
+}
+
+// Search starts at the newest match, so the next match is the next older one and
+// the previous match the next newer one, whichever keys they are bound to
+const (
+	nextMatchDir = -1
+	prevMatchDir = 1
+)
+
+// jumps to the next older (dir < 0) or newer (dir > 0) match
+func (cv *ChatView) NextMatch(dir int) {
+	cv.Lock()
+	defer cv.Unlock()
+	if len(cv.matches) == 0 {
+		return
+	}
+	cv.matchIdx += dir
+	if cv.matchIdx < 0 {
+		cv.matchIdx = 0
+	} else if cv.matchIdx >= len(cv.matches) {
+		cv.matchIdx = len(cv.matches) - 1
+	}
+	cv.showMatch()
+}
+
+// redraws the visible part of the scrollback into v
+func (cv *ChatView) Render(v *gocui.View) {
+	cv.Lock()
+	defer cv.Unlock()
+	width, height := v.Size()
+	if cv.scroll > 0 {
+		height-- // leave room for the indicator
+	}
+	end := len(cv.lines) - cv.scroll
+	start, rows := end, 0
+	for start > 0 {
+		r := displayRows(cv.lines[start-1], width)
+		if rows+r > height {
+			break
+		}
+		rows += r
+		start--
+	}
+	v.Clear()
+	for i := start; i < end; i++ {
+		fmt.Fprintln(v, cv.decorate(i))
+	}
+	if cv.scroll > 0 {
+		fmt.Fprint(v, printInfo(fmt.Sprintf("-- %d new below, End to jump back --", cv.unseen)))
+	}
+}
+
+// returns line idx with search matches highlighted. Only the text between escape
+// sequences is searched, and the colors in effect are restored after each match
+func (cv *ChatView) decorate(idx int) string {
+	line := cv.lines[idx]
+	if cv.pattern == nil || !cv.lineMatches(idx) {
+		return line
+	}
+	highlight := highlightMatch
+	if len(cv.matches) > 0 && cv.matches[cv.matchIdx] == idx {
+		highlight = highlightCurrent
+	}
+	var (
+		decorated string
+		active    string // escapes since the last reset
+		last      int
+	)
+	for _, loc := range ansiEscape.FindAllStringIndex(line, -1) {
+		decorated += cv.highlight(line[last:loc[0]], highlight, active)
+		escape := line[loc[0]:loc[1]]
+		decorated += escape
+		if escape == resetAttributes || escape == "\x1b[m" {
+			active = ""
+		} else {
+			active += escape
+		}
+		last = loc[1]
+	}
+	return decorated + cv.highlight(line[last:], highlight, active)
+}
+
+// wraps each match in text with highlight, then switches back to active
+func (cv *ChatView) highlight(text, highlight, active string) string {
+	return cv.pattern.ReplaceAllStringFunc(text, func(m string) string {
+		return highlight + m + resetAttributes + active
+	})
+}
+
+func (cv *ChatView) lineMatches(idx int) bool {
+	return cv.pattern.MatchString(ansiEscape.ReplaceAllString(cv.lines[idx], ""))
+}
+
+func (cv *ChatView) findMatches() {
+	cv.matches = nil
+	cv.matchIdx = 0
+	if cv.pattern == nil {
+		return
+	}
+	for idx := range cv.lines {
+		if cv.lineMatches(idx) {
+			cv.matches = append(cv.matches, idx)
+		}
+	}
+}
+
+// scrolls so the current match is the bottom line
+func (cv *ChatView) showMatch() {
+	cv.scroll = len(cv.lines) - 1 - cv.matches[cv.matchIdx]
+	cv.clampScroll()
+}
+
+func (cv *ChatView) clampScroll() {
+	if cv.scroll > len(cv.lines)-1 {
+		cv.scroll = len(cv.lines) - 1
+	}
+	if cv.scroll <= 0 {
+		cv.scroll = 0
+		cv.unseen = 0
+	}
+}
+
+// how many rows line takes up in a wrapping view of the given width
+func displayRows(line string, width int) int {
+	n := utf8.RuneCountInString(ansiEscape.ReplaceAllString(line, ""))
+	if width <= 0 || n == 0 {
+		return 1
+	}
+	return (n + width - 1) / width
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestChatViewDecorate(t *testing.T) {
+	const (
+		yellow = "\x1b[33m"
+		bold   = "\x1b[1m"
+	)
+	for _, test := range []struct {
+		name, line, query, want string
+	}{
+		{"plain", "hello there", "the",
+			"hello " + highlightCurrent + "the" + resetAttributes + "re"},
+		{"case", "Hello", "hello",
+			highlightCurrent + "Hello" + resetAttributes},
+		// the query appears only inside the escape sequence
+		{"escape", yellow + "[bob]" + resetAttributes + " hi", "3",
+			yellow + "[bob]" + resetAttributes + " hi"},
+		{"brackets", yellow + "[bob]" + resetAttributes + " hi", "[",
+			yellow + highlightCurrent + "[" + resetAttributes + yellow + "bob]" + resetAttributes + " hi"},
+		{"restores colors", bold + yellow + "bob says hi" + resetAttributes, "says",
+			bold + yellow + "bob " + highlightCurrent + "says" + resetAttributes + bold + yellow + " hi" + resetAttributes},
+		{"after reset", yellow + "bob" + resetAttributes + " says hi", "hi",
+			yellow + "bob" + resetAttributes + " says " + highlightCurrent + "hi" + resetAttributes},
+	} {
+		cv := NewChatView(10)
+		cv.Append(test.line)
+		if n := cv.Search(test.query); n != 1 && test.name != "escape" {
+			t.Errorf("%s: %d matches, want 1", test.name, n)
+		}
+		if got := cv.decorate(0); got != test.want {
+			t.Errorf("%s: decorated %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestChatViewSearch(t *testing.T) {
+	cv := NewChatView(10)
+	for _, line := range []string{"one", "\x1b[33mtwo\x1b[0m", "three", "Two more"} {
+		cv.Append(line)
+	}
+	if n := cv.Search("two"); n != 2 {
+		t.Errorf("%d matches, want 2", n)
+	}
+	// only the newest match is current
+	if got := cv.decorate(1); got != "\x1b[33m"+highlightMatch+"two"+resetAttributes+"\x1b[33m\x1b[0m" {
+		t.Errorf("Older match decorated %q", got)
+	}
+	cv.Append("two again")
+	if n := len(cv.matches); n != 3 {
+		t.Errorf("%d matches after appending, want 3", n)
+	}
+	if n := cv.Search("33m"); n != 0 {
+		t.Errorf("Matched %d lines on their escape sequences", n)
+	}
+	if n := cv.Search(""); n != 0 || cv.decorate(3) != "Two more" {
+		t.Error("Clearing the search left highlights")
+	}
+}
+
+func TestChatViewNextMatch(t *testing.T) {
+	cv := NewChatView(10)
+	for _, line := range []string{"match 0", "other", "match 2", "match 3"} {
+		cv.Append(line)
+	}
+	cv.Search("match")
+	current := func() int { return cv.matches[cv.matchIdx] }
+	if idx := current(); idx != 3 {
+		t.Fatalf("Search started at line %d, want the newest match", idx)
+	}
+	for _, test := range []struct {
+		dir  int
+		want int
+	}{
+		{nextMatchDir, 2},
+		{nextMatchDir, 0},
+		// stays on the oldest
+		{nextMatchDir, 0},
+		{prevMatchDir, 2},
+		{prevMatchDir, 3},
+		{prevMatchDir, 3},
+	} {
+		cv.NextMatch(test.dir)
+		if idx := current(); idx != test.want {
+			t.Errorf("Moved %d to line %d, want %d", test.dir, idx, test.want)
+		}
+	}
+}
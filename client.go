@@ -1,76 +1,319 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"fmt"
-	"github.com/fatih/color"
 	"github.com/gtfierro/ordo/core"
 	"github.com/pkg/errors"
-	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-var printRed = color.New(color.FgRed).SprintFunc()
-var printYellow = color.New(color.FgYellow).SprintFunc()
-var printGreen = color.New(color.FgGreen).SprintFunc()
-
 type OrdoClient struct {
 	ordo  *core.OrdoCore
 	Alias string
+	// root namespace rooms joined by name alone are looked up under
+	Namespace string
 
-	Input      *bufio.Reader
-	Screen     chan core.Message
-	roomStates chan core.RoomState
+	// messages from the current room
+	Screen chan core.Message
+	// output from the client itself, shown alongside Screen
+	Notices chan Notice
 
 	roomLock    sync.RWMutex
 	currentRoom *core.Room
+	// URI of currentRoom, readable without waiting on roomLock
+	currentURI atomic.Value
+	// URIs of every room we have tried to join this session
+	seenRooms map[string]bool
 
 	stopTailing chan bool
+
+	// alerts for mentions in rooms other than currentRoom
+	notifier *Notifier
+	// remembers joined rooms and the autojoin list between runs
+	session *SessionStore
+	// URIs of rooms where join, leave, nick and topic events are hidden
+	quietRooms map[string]bool
 }
 
-func NewOrdoClient(entityfile, alias string) *OrdoClient {
+func NewOrdoClient(entityfile, alias, namespace string, opts ...core.Option) (*OrdoClient, error) {
+	opts = append([]core.Option{core.WithEntityFile(entityfile), core.WithAlias(alias)}, opts...)
+	ordo, err := core.New(opts...)
+	if err != nil {
+		return nil, err
+	}
 	oc := &OrdoClient{
-		ordo:        core.NewOrdoCore(entityfile, alias),
+		ordo:        ordo,
 		Alias:       alias,
-		Input:       bufio.NewReader(os.Stdin),
+		Namespace:   namespace,
 		Screen:      make(chan core.Message, 100),
-		roomStates:  make(chan core.RoomState, 100),
+		Notices:     make(chan Notice, 100),
 		stopTailing: make(chan bool),
+		seenRooms:   make(map[string]bool),
+		quietRooms:  make(map[string]bool),
 	}
 
-	// display ordo messages on screen
+	go oc.handleEvents(oc.ordo.Subscribe(100, core.DropOldest))
+
+	if unsent := len(oc.ordo.Outbox()); unsent > 0 {
+		oc.display(printInfo(unsent, " messages from the last session have not been sent yet; see \\retry and \\discard"))
+	}
+
+	return oc, nil
+}
+
+// a line of text from the client itself rather than from a room
+type Notice struct {
+	Text string
+	Time time.Time
+}
+
+// our verifying key
+func (oc *OrdoClient) VK() string {
+	return oc.ordo.VK()
+}
+
+// returns a subscription to events from every joined room
+func (oc *OrdoClient) Subscribe(size int, policy core.Backpressure) *core.Subscription {
+	return oc.ordo.Subscribe(size, policy)
+}
+
+func (oc *OrdoClient) display(s string) {
+	oc.Notices <- Notice{Text: s, Time: time.Now()}
+}
+
+// reacts to events from the core: mentions are notified and errors displayed
+func (oc *OrdoClient) handleEvents(sub *core.Subscription) {
+	for ev := range sub.C {
+		switch ev := ev.(type) {
+		case core.ChatReceived:
+			oc.notify(ev.Message)
+		case core.ConnectionChanged:
+			if ev.Connected {
+				oc.display(printSuccess("Reconnected to BOSSWAVE agent"))
+			} else {
+				oc.display(printError("Lost connection to BOSSWAVE agent, reconnecting (", ev.Err, ")"))
+			}
+		case core.Error:
+			if ev.Room != nil {
+				oc.display(printError(ev.Room.Name, ": ", ev.Err))
+			} else {
+				oc.display(printError(ev.Err))
+			}
+		}
+	}
+}
+
+// configure how the user is alerted to mentions in other rooms
+func (oc *OrdoClient) SetNotifier(n *Notifier) {
+	oc.roomLock.Lock()
+	defer oc.roomLock.Unlock()
+	oc.notifier = n
+}
+
+func (oc *OrdoClient) notify(msg core.Message) {
+	if !msg.Mention {
+		return
+	}
+	oc.roomLock.RLock()
+	notifier := oc.notifier
+	active := oc.currentRoom != nil && oc.currentRoom == msg.Room
+	oc.roomLock.RUnlock()
+	if notifier == nil || active {
+		return
+	}
+	// notification commands may be slow, so don't hold up the room
 	go func() {
-		for msg := range oc.ordo.Log {
-			oc.display(msg)
+		if err := notifier.Notify(msg); err != nil {
+			log.Error(err)
 		}
 	}()
+}
+
+// remember joined rooms and the autojoin list in the given store
+func (oc *OrdoClient) SetSessionStore(store *SessionStore) {
+	oc.session = store
+	oc.roomLock.Lock()
+	defer oc.roomLock.Unlock()
+	for _, uri := range store.QuietRooms() {
+		oc.quietRooms[uri] = true
+	}
+}
 
-	return oc
+// whether join, leave, nick and topic events are shown in the room
+func (oc *OrdoClient) ShowsEvents(roomURI string) bool {
+	oc.roomLock.RLock()
+	defer oc.roomLock.RUnlock()
+	return !oc.quietRooms[roomURI]
 }
 
-func (oc *OrdoClient) display(s string) {
-	oc.Screen <- core.Message{
-		From:    "<<System>>",
-		Message: s,
+// handles \events on|off for the current room
+func (oc *OrdoClient) toggleEvents(args []string) error {
+	uri := oc.CurrentRoomURI()
+	if len(uri) == 0 {
+		return errors.New("Must join room first: \\join <roomuri>")
+	}
+	var quiet bool
+	switch strings.TrimSpace(strings.Join(args, "")) {
+	case "on":
+		quiet = false
+	case "off":
+		quiet = true
+	case "":
+		if oc.ShowsEvents(uri) {
+			oc.display(printInfo("Events are shown in ", uri))
+		} else {
+			oc.display(printInfo("Events are hidden in ", uri))
+		}
+		return nil
+	default:
+		return errors.New("Usage: \\events [on|off]")
 	}
+	oc.roomLock.Lock()
+	if quiet {
+		oc.quietRooms[uri] = true
+	} else {
+		delete(oc.quietRooms, uri)
+	}
+	oc.roomLock.Unlock()
+	if quiet {
+		oc.display(printSuccess("Hiding events in ", uri))
+	} else {
+		oc.display(printSuccess("Showing events in ", uri))
+	}
+	if oc.session == nil {
+		return nil
+	}
+	oc.session.SetQuiet(uri, quiet)
+	return oc.session.Save()
 }
 
-func (oc *OrdoClient) tailRoomState(state core.RoomState) {
-	oc.roomStates <- state
+// handles \topic [text]: shows the current room's topic, or sets it
+func (oc *OrdoClient) topic(args []string) error {
+	oc.roomLock.RLock()
+	room := oc.currentRoom
+	oc.roomLock.RUnlock()
+	if room == nil {
+		return errors.New("Must join room first: \\join <roomuri>")
+	}
+	topic := strings.TrimSpace(strings.Join(args, ""))
+	if len(topic) == 0 {
+		if current := room.Topic(); len(current) > 0 {
+			oc.display(printInfo("Topic of ", room.Name, ": ", current))
+		} else {
+			oc.display(printInfo("No topic set in ", room.Name))
+		}
+		return nil
+	}
+	return room.SetTopic(context.Background(), topic)
+}
+
+// records the joined rooms and the current room in the session store and saves it
+func (oc *OrdoClient) saveSession() {
+	if oc.session == nil {
+		return
+	}
+	var joined []string
+	for _, room := range oc.ordo.GetRooms() {
+		if room.IsAlive() {
+			joined = append(joined, room.URI)
+		}
+	}
+	sort.Strings(joined)
+	oc.session.SetJoined(joined, oc.CurrentRoomURI())
+	if err := oc.session.Save(); err != nil {
+		oc.display(printError("Could not save session ", err))
+	}
+}
+
+func (oc *OrdoClient) autojoin(args []string) error {
+	if oc.session == nil {
+		return errors.New("No session store to keep the autojoin list in")
+	}
+	if len(args) < 1 {
+		return errors.New("Usage: \\autojoin add|remove|list [uri]")
+	}
+	switch strings.TrimSpace(args[0]) {
+	case "list":
+		rooms := oc.session.Autojoin()
+		if len(rooms) == 0 {
+			oc.display(printInfo("Autojoin list is empty"))
+			return nil
+		}
+		tmp := "Autojoin:\n"
+		for _, uri := range rooms {
+			tmp += fmt.Sprintf("%s\n", uri)
+		}
+		tmp += "\n---\n"
+		oc.display(printInfo(tmp))
+		return nil
+	case "add", "remove":
+		if len(args) < 2 {
+			return errors.New(fmt.Sprintf("Usage: \\autojoin %s <uri>", strings.TrimSpace(args[0])))
+		}
+		uri := oc.expandRoomURI(strings.TrimSpace(args[1]))
+		if strings.TrimSpace(args[0]) == "add" {
+			if !oc.session.AddAutojoin(uri) {
+				oc.display(printInfo(uri, " is already in the autojoin list"))
+				return nil
+			}
+			oc.display(printSuccess("Added ", uri, " to the autojoin list"))
+		} else {
+			if !oc.session.RemoveAutojoin(uri) {
+				oc.display(printInfo(uri, " is not in the autojoin list"))
+				return nil
+			}
+			oc.display(printSuccess("Removed ", uri, " from the autojoin list"))
+		}
+		return oc.session.Save()
+	}
+	return errors.New(fmt.Sprintf("Unknown autojoin subcommand %s", args[0]))
 }
 
 func (oc *OrdoClient) runCommand(cmd Command) {
 	switch cmd.Type {
 	case JoinCommand:
 		if err := oc.JoinRoom(cmd.Args); err != nil {
-			oc.display(printRed("Error joining", err))
+			oc.display(printError("Error joining", err))
 		} else {
-			oc.display(printGreen("Joined ", cmd.Args[0]))
+			oc.display(printSuccess("Joined ", oc.CurrentRoomURI()))
+			oc.saveSession()
 		}
 	case LeaveCommand:
 		if err := oc.LeaveRoom(cmd.Args); err != nil {
-			oc.display(printRed("Error leaving", err))
+			oc.display(printError("Error leaving", err))
+		}
+		oc.saveSession()
+	case RetryCommand:
+		ids, err := parseOutboundIDs(cmd.Args)
+		if err != nil {
+			oc.display(printError("Error: ", err))
+		} else {
+			oc.display(printInfo(fmt.Sprintf("Retrying %d failed messages", oc.ordo.Retry(ids...))))
+		}
+	case DiscardCommand:
+		ids, err := parseOutboundIDs(cmd.Args)
+		if err != nil {
+			oc.display(printError("Error: ", err))
+		} else {
+			oc.display(printInfo(fmt.Sprintf("Discarded %d failed messages", oc.ordo.Discard(ids...))))
+		}
+	case EventsCommand:
+		if err := oc.toggleEvents(cmd.Args); err != nil {
+			oc.display(printError("Error: ", err))
+		}
+	case TopicCommand:
+		if err := oc.topic(cmd.Args); err != nil {
+			oc.display(printError("Error: ", err))
+		}
+	case AutojoinCommand:
+		if err := oc.autojoin(cmd.Args); err != nil {
+			oc.display(printError("Error: ", err))
 		}
 	case ListJoinedRoomsCommand:
 		rooms := oc.ordo.GetRooms()
@@ -80,22 +323,56 @@ func (oc *OrdoClient) runCommand(cmd Command) {
 				tmp += fmt.Sprintf("%s\n", room.URI)
 			}
 			tmp += "\n---\n"
-			oc.display(printYellow(tmp))
+			oc.display(printInfo(tmp))
+		} else {
+			oc.display(printInfo("No rooms joined"))
+		}
+	case MentionsCommand:
+		mentions := oc.ordo.GetMentions()
+		if len(mentions) > 0 {
+			tmp := "Mentions:\n"
+			for _, msg := range mentions {
+				tmp += fmt.Sprintf("%s [%s]> %s\n", msg.Room.Name, msg.From, msg.Message)
+			}
+			tmp += "\n---\n"
+			oc.display(printInfo(tmp))
 		} else {
-			oc.display(printYellow("No rooms joined"))
+			oc.display(printInfo("No mentions"))
 		}
 	//case ERRORCommand:
-	//	cc.display(printRed(fmt.Sprintf("ERROR: unrecognized command: %+v", cmd)))
+	//	cc.display(printError(fmt.Sprintf("ERROR: unrecognized command: %+v", cmd)))
 	case HelpCommand:
-		oc.display(printYellow("\\join <uri> -- join the room if you have permission"))
-		oc.display(printYellow("\\leave -- Leaves the room, but also causes echoing characters to stop BUGGY DO NOT USE"))
-		oc.display(printYellow("\\listjoined -- Lists the rooms you have joined"))
-		oc.display(printYellow("\\help-- Prints this help"))
+		oc.display(printInfo("\\join <uri> -- join the room if you have permission"))
+		oc.display(printInfo("\\leave [reason] -- Leaves the current room"))
+		oc.display(printInfo("\\listjoined -- Lists the rooms you have joined"))
+		oc.display(printInfo("\\mentions -- Lists recent mentions across all joined rooms"))
+		oc.display(printInfo("\\autojoin add|remove <uri> -- Manage the rooms joined on every startup"))
+		oc.display(printInfo("\\autojoin list -- Lists the rooms joined on every startup"))
+		oc.display(printInfo("\\topic [text] -- Shows or sets the topic of the current room"))
+		oc.display(printInfo("\\events [on|off] -- Shows or hides joins, leaves and other events in the current room"))
+		oc.display(printInfo("\\retry [id ...] -- Sends failed messages again (all of them if no ids are given)"))
+		oc.display(printInfo("\\discard [id ...] -- Throws away failed messages (all of them if no ids are given)"))
+		oc.display(printInfo("\\quit [reason] -- Leaves every room and exits"))
+		oc.display(printInfo("\\help-- Prints this help"))
+		oc.display(printInfo("PgUp/PgDn/Home/End -- scroll the chat, / -- search it, Alt-n/Alt-p -- next (older)/previous (newer) match"))
+		oc.display(printInfo("Alt-Left/Alt-Right -- switch rooms, Alt-r -- mark all read"))
+		oc.display(printInfo("F2 -- toggle member list, F3 -- toggle sidebar, F4 -- select members (arrows to move)"))
+		oc.display(printInfo("(default keys; see --keymap)"))
 	default:
 		oc.SendMessage(strings.Join(cmd.Args, " "))
 	}
 }
 
+// highlight messages containing the given keyword in addition to our alias
+func (oc *OrdoClient) AddHighlightKeyword(keyword string) {
+	oc.ordo.AddMentionKeyword(keyword)
+}
+
+// highlight messages matching the given regular expression
+func (oc *OrdoClient) AddHighlightPattern(expr string) error {
+	return oc.ordo.AddMentionPattern(expr)
+}
+
 func (oc *OrdoClient) JoinRoom(args []string) error {
 	var (
 		roomURI string // args 0
@@ -104,17 +381,18 @@ func (oc *OrdoClient) JoinRoom(args []string) error {
 	if len(args) < 1 {
 		return errors.New("Need 1 argument to JoinRoom")
 	}
-	roomURI = args[0]
+	roomURI = oc.expandRoomURI(strings.TrimSpace(args[0]))
 
 	oc.roomLock.Lock()
 	defer oc.roomLock.Unlock()
+	oc.seenRooms[roomURI] = true
 
 	if oc.currentRoom != nil && oc.currentRoom.URI == roomURI {
-		oc.display(printYellow("Already in room ", roomURI))
+		oc.display(printInfo("Already in room ", roomURI))
 		return nil
 	}
 
-	room, err := oc.ordo.JoinRoom(roomURI)
+	room, err := oc.ordo.JoinRoom(context.Background(), roomURI)
 	if err != nil {
 		return errors.Wrap(err, fmt.Sprintf("Could not join room %s", roomURI))
 	}
@@ -122,35 +400,161 @@ func (oc *OrdoClient) JoinRoom(args []string) error {
 		oc.currentRoom.StopTail()
 	}
 	room.StartTail(oc.Screen)
-	room.SetStateUpdateCallback(oc.tailRoomState)
 	oc.currentRoom = room
+	oc.currentURI.Store(room.URI)
 	return nil
 }
 
+// returns the URI of the room we are talking in, or "" if none
+func (oc *OrdoClient) CurrentRoomURI() string {
+	uri, _ := oc.currentURI.Load().(string)
+	return uri
+}
+
+// returns the URI of the joined room delta places after the current one, ordered
+// by URI and wrapping around. Returns "" if no rooms are joined
+func (oc *OrdoClient) AdjacentRoomURI(delta int) string {
+	var uris []string
+	for _, room := range oc.ordo.GetRooms() {
+		if room.IsAlive() {
+			uris = append(uris, room.URI)
+		}
+	}
+	if len(uris) == 0 {
+		return ""
+	}
+	sort.Strings(uris)
+	current := 0
+	for i, uri := range uris {
+		if uri == oc.CurrentRoomURI() {
+			current = i
+		}
+	}
+	next := (current + delta) % len(uris)
+	if next < 0 {
+		next += len(uris)
+	}
+	return uris[next]
+}
+
+// clears the unread and mention counts of every joined room
+func (oc *OrdoClient) MarkAllRead() {
+	for _, room := range oc.ordo.GetRooms() {
+		room.MarkRead()
+	}
+}
+
+func (oc *OrdoClient) expandRoomURI(room string) string {
+	return expandRoomURI(oc.Namespace, room)
+}
+
+// a room given by name alone (no '/') lives at <namespace>room/<name>
+func expandRoomURI(namespace, room string) string {
+	if strings.Contains(room, "/") || len(namespace) == 0 {
+		return room
+	}
+	return strings.TrimSuffix(namespace, "/") + "/room/" + room
+}
+
+// returns the URIs of joined rooms and rooms we have tried to join before
+func (oc *OrdoClient) KnownRoomURIs() []string {
+	oc.roomLock.RLock()
+	defer oc.roomLock.RUnlock()
+	seen := make(map[string]bool, len(oc.seenRooms))
+	for uri := range oc.seenRooms {
+		seen[uri] = true
+	}
+	for _, room := range oc.ordo.GetRooms() {
+		seen[room.URI] = true
+	}
+	uris := make([]string, 0, len(seen))
+	for uri := range seen {
+		uris = append(uris, uri)
+	}
+	return uris
+}
+
+// returns the topic of the current room, or "" if none is set
+func (oc *OrdoClient) CurrentRoomTopic() string {
+	oc.roomLock.RLock()
+	defer oc.roomLock.RUnlock()
+	if oc.currentRoom == nil {
+		return ""
+	}
+	return oc.currentRoom.Topic()
+}
+
+// returns the aliases of the users in the current room
+func (oc *OrdoClient) CurrentRoomAliases() []string {
+	oc.roomLock.RLock()
+	defer oc.roomLock.RUnlock()
+	if oc.currentRoom == nil {
+		return nil
+	}
+	return oc.currentRoom.Aliases()
+}
+
 func (oc *OrdoClient) LeaveRoom(args []string) error {
 	oc.roomLock.Lock()
 	defer oc.roomLock.Unlock()
 	if oc.currentRoom == nil {
-		oc.display(printYellow("Not in a room to leave"))
+		oc.display(printInfo("Not in a room to leave"))
 		return nil
 	}
-	var reason string
-	if len(args) == 0 {
+	reason := strings.TrimSpace(strings.Join(args, ""))
+	if len(reason) == 0 {
 		reason = "<No reason given>"
-	} else {
-		reason = args[0]
 	}
-	err := oc.currentRoom.Leave(reason)
+	oc.currentRoom.StopTail()
+	err := oc.currentRoom.Leave(context.Background(), reason)
 	oc.currentRoom = nil
+	oc.currentURI.Store("")
 	return err
 }
 
+// saves the session, then leaves every joined room with the given reason, giving
+// up on telling the rooms when ctx is done. Returns an error naming the rooms that
+// could not be left
+func (oc *OrdoClient) Shutdown(ctx context.Context, reason string) error {
+	oc.saveSession()
+	if len(reason) == 0 {
+		reason = "<No reason given>"
+	}
+
+	oc.roomLock.Lock()
+	defer oc.roomLock.Unlock()
+	if oc.currentRoom != nil {
+		oc.currentRoom.StopTail()
+		oc.currentRoom = nil
+		oc.currentURI.Store("")
+	}
+	return oc.ordo.Close(ctx, reason)
+}
+
 func (oc *OrdoClient) SendMessage(msg string) {
 	oc.roomLock.Lock()
 	defer oc.roomLock.Unlock()
 	if oc.currentRoom == nil {
-		oc.display(printYellow("Must join room first: \\join <roomuri>"))
+		oc.display(printInfo("Must join room first: \\join <roomuri>"))
 		return
 	}
-	oc.currentRoom.Speak(msg)
+	// the outbox shows progress and keeps the message if it cannot be sent
+	oc.currentRoom.Send(msg)
+}
+
+// parses the arguments of \retry and \discard
+func parseOutboundIDs(args []string) ([]uint64, error) {
+	var ids []uint64
+	for _, arg := range args {
+		arg = strings.TrimSpace(arg)
+		if len(arg) == 0 {
+			continue
+		}
+		id, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid message id %s", arg))
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
 }
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// returns the possible completions for word. If first is true, word is the first
+// word on the input line
+type CompleteFunc func(word string, first bool) []string
+
+// completes '\' commands at the start of the line, and aliases from the current
+// room and known room URIs everywhere else
+func (oc *OrdoClient) Complete(word string, first bool) []string {
+	var candidates []string
+	if first && strings.HasPrefix(word, "\\") {
+		candidates = CommandNames()
+	} else {
+		candidates = append(oc.CurrentRoomAliases(), oc.KnownRoomURIs()...)
+	}
+	var matches []string
+	seen := make(map[string]bool)
+	for _, c := range candidates {
+		if strings.HasPrefix(c, word) && !seen[c] {
+			matches = append(matches, c)
+			seen[c] = true
+		}
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+// longest prefix shared by all of the given strings, never splitting a character
+func commonPrefix(words []string) string {
+	if len(words) == 0 {
+		return ""
+	}
+	prefix := []rune(words[0])
+	for _, w := range words[1:] {
+		runes := []rune(w)
+		n := 0
+		for n < len(prefix) && n < len(runes) && prefix[n] == runes[n] {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+	return string(prefix)
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCommonPrefix(t *testing.T) {
+	for _, test := range []struct {
+		words []string
+		want  string
+	}{
+		{nil, ""},
+		{[]string{"hello"}, "hello"},
+		{[]string{"help", "hello"}, "hel"},
+		{[]string{"abc", "xyz"}, ""},
+		{[]string{"héllo", "hèllo"}, "h"},
+		{[]string{"héllo", "héllá"}, "héll"},
+		{[]string{"日本語", "日本"}, "日本"},
+	} {
+		if got := commonPrefix(test.words); got != test.want {
+			t.Errorf("commonPrefix(%q) = %q, want %q", test.words, got, test.want)
+		}
+	}
+}
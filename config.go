@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Profile bundles the settings for a client session. Empty fields fall back to
+// the command line defaults
+type Profile struct {
+	// name of the profile in the config file, if any
+	Name           string   `json:"-"`
+	Entity         string   `json:"entity"`
+	Alias          string   `json:"alias"`
+	Namespace      string   `json:"namespace"`
+	Autojoin       []string `json:"autojoin"`
+	Theme          string   `json:"theme"`
+	Keymap         string   `json:"keymap"`
+	Notify         string   `json:"notify"`
+	NotifyCommand  string   `json:"notify_command"`
+	Highlight      []string `json:"highlight"`
+	HighlightRegex []string `json:"highlight_regex"`
+	Format         string   `json:"format"`
+	SystemFormat   string   `json:"system_format"`
+	TimeFormat     string   `json:"time_format"`
+}
+
+// Config is the contents of the configuration file: a set of named profiles and
+// which one to use when --profile is not given
+type Config struct {
+	DefaultProfile string             `json:"default_profile"`
+	Profiles       map[string]Profile `json:"profiles"`
+}
+
+// $XDG_CONFIG_HOME/bw2chat, or ~/.config/bw2chat
+func configDir() string {
+	base := os.Getenv("XDG_CONFIG_HOME")
+	if len(base) == 0 {
+		base = filepath.Join(os.Getenv("HOME"), ".config")
+	}
+	return filepath.Join(base, "bw2chat")
+}
+
+func DefaultConfigPath() string {
+	return filepath.Join(configDir(), "config.json")
+}
+
+// loads the configuration file at path. A missing file at the default path is not
+// an error and gives an empty configuration
+func LoadConfig(path string) (*Config, error) {
+	cfg := &Config{Profiles: make(map[string]Profile)}
+	explicit := len(path) > 0
+	if !explicit {
+		path = DefaultConfigPath()
+	}
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !explicit {
+		return cfg, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Could not read config file %s", path))
+	}
+	if err := json.Unmarshal(contents, cfg); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Could not parse config file %s", path))
+	}
+	return cfg, nil
+}
+
+// returns the named profile, or the default profile if name is empty
+func (cfg *Config) Profile(name string) (Profile, error) {
+	if len(name) == 0 {
+		name = cfg.DefaultProfile
+	}
+	if len(name) == 0 {
+		return Profile{}, nil
+	}
+	profile, found := cfg.Profiles[name]
+	if !found {
+		return Profile{}, errors.New(fmt.Sprintf("No profile named %s", name))
+	}
+	return profile, nil
+}
+
+// works out the settings for this session: flags given on the command line win,
+// then values from the selected profile, then the flag defaults
+func resolveProfile(c *cli.Context) (Profile, error) {
+	cfg, err := LoadConfig(c.GlobalString("config"))
+	if err != nil {
+		return Profile{}, err
+	}
+	name := c.GlobalString("profile")
+	if len(name) == 0 {
+		name = cfg.DefaultProfile
+	}
+	profile, err := cfg.Profile(name)
+	if err != nil {
+		return Profile{}, err
+	}
+	str := func(flag string, global bool, fromProfile string) string {
+		if global {
+			if !c.GlobalIsSet(flag) && len(fromProfile) > 0 {
+				return fromProfile
+			}
+			return c.GlobalString(flag)
+		}
+		if !c.IsSet(flag) && len(fromProfile) > 0 {
+			return fromProfile
+		}
+		return c.String(flag)
+	}
+	slice := func(flag string, fromProfile []string) []string {
+		if !c.IsSet(flag) && fromProfile != nil {
+			return fromProfile
+		}
+		return c.StringSlice(flag)
+	}
+	return Profile{
+		Name:           name,
+		Entity:         str("entity", true, profile.Entity),
+		Namespace:      str("namespace", true, profile.Namespace),
+		Alias:          str("alias", false, profile.Alias),
+		Autojoin:       slice("room", profile.Autojoin),
+		Theme:          str("theme", false, profile.Theme),
+		Keymap:         str("keymap", false, profile.Keymap),
+		Notify:         str("notify", false, profile.Notify),
+		NotifyCommand:  str("notify-command", false, profile.NotifyCommand),
+		Highlight:      slice("highlight", profile.Highlight),
+		HighlightRegex: slice("highlight-regex", profile.HighlightRegex),
+		Format:         str("format", false, profile.Format),
+		SystemFormat:   str("system-format", false, profile.SystemFormat),
+		TimeFormat:     str("time-format", false, profile.TimeFormat),
+	}, nil
+}
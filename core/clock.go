@@ -0,0 +1,77 @@
+package core
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// number of recent message IDs each room remembers to drop duplicates
+const DedupWindow = 1000
+
+// Clock is a hybrid logical clock. Its timestamps follow wall time but never go
+// backwards, and seeing a timestamp from another client pushes ours past it, so
+// ordering by timestamp respects causality even when wall clocks disagree.
+// A timestamp is milliseconds since the epoch shifted left 16 bits, plus a counter
+type Clock struct {
+	mu   sync.Mutex
+	last uint64
+}
+
+// returns a timestamp later than any this clock has issued or observed
+func (c *Clock) Now() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	wall := uint64(time.Now().UnixNano()/int64(time.Millisecond)) << 16
+	if wall > c.last {
+		c.last = wall
+	} else {
+		c.last++
+	}
+	return c.last
+}
+
+// records a timestamp from another client
+func (c *Clock) Observe(ts uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ts > c.last {
+		c.last = ts
+	}
+}
+
+// returns a random ID for a message we are about to send
+func newMessageID() string {
+	var id [12]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		// fall back to something unique to us
+		return hex.EncodeToString([]byte(time.Now().Format(time.RFC3339Nano)))
+	}
+	return hex.EncodeToString(id[:])
+}
+
+// remembers the last max IDs seen
+type idWindow struct {
+	ids   map[string]struct{}
+	order []string
+	max   int
+}
+
+func newIDWindow(max int) *idWindow {
+	return &idWindow{ids: make(map[string]struct{}), max: max}
+}
+
+// records id, returning false if it was already seen
+func (w *idWindow) add(id string) bool {
+	if _, found := w.ids[id]; found {
+		return false
+	}
+	w.ids[id] = struct{}{}
+	w.order = append(w.order, id)
+	if len(w.order) > w.max {
+		delete(w.ids, w.order[0])
+		w.order = w.order[1:]
+	}
+	return true
+}
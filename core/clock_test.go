@@ -0,0 +1,93 @@
+package core
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClockNowIncreases(t *testing.T) {
+	var c Clock
+	last := c.Now()
+	// many calls land in the same millisecond, so the counter has to carry them
+	for i := 0; i < 10000; i++ {
+		now := c.Now()
+		if now <= last {
+			t.Fatalf("Now returned %d after %d", now, last)
+		}
+		last = now
+	}
+}
+
+func TestClockNowConcurrent(t *testing.T) {
+	var c Clock
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		seen = make(map[uint64]bool)
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				ts := c.Now()
+				mu.Lock()
+				if seen[ts] {
+					t.Errorf("Timestamp %d issued twice", ts)
+				}
+				seen[ts] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestClockObserve(t *testing.T) {
+	var c Clock
+	// a clock an hour ahead of ours
+	future := uint64(time.Now().Add(time.Hour).UnixNano()/int64(time.Millisecond)) << 16
+	c.Observe(future)
+	if now := c.Now(); now <= future {
+		t.Errorf("Now returned %d after observing %d", now, future)
+	}
+
+	// observing the past changes nothing
+	before := c.Now()
+	c.Observe(1)
+	if now := c.Now(); now <= before {
+		t.Errorf("Now returned %d after %d", now, before)
+	}
+}
+
+func TestIDWindowDedup(t *testing.T) {
+	w := newIDWindow(10)
+	if !w.add("a") {
+		t.Error("First sighting of a reported as a duplicate")
+	}
+	if w.add("a") {
+		t.Error("Second sighting of a not reported as a duplicate")
+	}
+}
+
+func TestIDWindowEviction(t *testing.T) {
+	w := newIDWindow(3)
+	for i := 0; i < 4; i++ {
+		w.add(fmt.Sprint(i))
+	}
+	// 0 was pushed out by 3
+	if !w.add("0") {
+		t.Error("Evicted ID still remembered")
+	}
+	// adding 0 again pushed out 1, leaving 2, 3 and 0
+	for _, id := range []string{"2", "3", "0"} {
+		if w.add(id) {
+			t.Errorf("%s forgotten too early", id)
+		}
+	}
+	if len(w.ids) != 3 || len(w.order) != 3 {
+		t.Errorf("Window holds %d IDs in %d slots, want 3", len(w.ids), len(w.order))
+	}
+}
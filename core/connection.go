@@ -0,0 +1,217 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	bw "gopkg.in/immesys/bw2bind.v5"
+	"io"
+	"time"
+)
+
+const (
+	// first wait between attempts to reconnect to the agent
+	DefaultReconnectMin = time.Second
+	// longest wait between attempts to reconnect to the agent
+	DefaultReconnectMax = time.Minute
+	// how often to check the agent still answers
+	DefaultLivenessInterval = 30 * time.Second
+	// how long resubscribing each room may take after reconnecting
+	resubscribeTimeout = 30 * time.Second
+	// how long the agent may take to answer a liveness check
+	livenessTimeout = 10 * time.Second
+)
+
+// Transport is the part of a BOSSWAVE client the core uses. A *bw2bind.BW2Client
+// is one; WithTransport substitutes another, such as the fake agent in package coretest
+type Transport interface {
+	SetEntityFile(path string) (string, error)
+	OverrideAutoChainTo(enabled bool)
+	Publish(params *bw.PublishParams) error
+	SubscribeH(params *bw.SubscribeParams) (chan *bw.SimpleMessage, string, error)
+	Unsubscribe(handle string) error
+}
+
+// connects to the BOSSWAVE agent at addr
+func dialAgent(addr string) (Transport, error) {
+	client, err := bw.Connect(addr)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// connects to the agent and sets our entity, returning the client and our VK
+func connect(o *options) (Transport, string, error) {
+	client, err := o.dial(o.agent)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "Could not connect to BOSSWAVE agent")
+	}
+	vk, err := client.SetEntityFile(o.entityFile)
+	if err != nil {
+		closeTransport(client)
+		return nil, "", errors.Wrap(err, fmt.Sprintf("Could not use entity file %s", o.entityFile))
+	}
+	client.OverrideAutoChainTo(o.autoChain)
+	return client, vk, nil
+}
+
+// the current connection to the agent
+func (ordo *OrdoCore) client() Transport {
+	ordo.connLock.RLock()
+	defer ordo.connLock.RUnlock()
+	return ordo.bw
+}
+
+// closes t if it can be closed, dropping its subscriptions
+func closeTransport(t Transport) {
+	if closer, ok := t.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// whether client is the connection in use and not known to be dead
+func (ordo *OrdoCore) usable(client Transport) bool {
+	ordo.connLock.RLock()
+	defer ordo.connLock.RUnlock()
+	return client == ordo.bw && client != ordo.lost
+}
+
+// whether we believe the agent connection is up
+func (ordo *OrdoCore) Connected() bool {
+	ordo.connLock.RLock()
+	defer ordo.connLock.RUnlock()
+	return !ordo.reconnecting
+}
+
+// called when something suggests the agent has gone away. Starts reconnecting
+// unless that is already under way
+func (ordo *OrdoCore) connectionLost(err error) {
+	ordo.connLock.Lock()
+	if ordo.reconnecting {
+		ordo.connLock.Unlock()
+		return
+	}
+	ordo.reconnecting = true
+	ordo.lost = ordo.bw
+	ordo.connLock.Unlock()
+
+	log.Warningf("Lost connection to BOSSWAVE agent (%s)", err)
+	ordo.events.Publish(ConnectionChanged{Connected: false, Err: err})
+	go ordo.reconnect()
+}
+
+// reconnects to the agent, then resubscribes every joined room, backing off
+// between failed attempts until it works or the core is closed
+func (ordo *OrdoCore) reconnect() {
+	delay := ordo.opts.reconnectMin
+	for {
+		select {
+		case <-ordo.closed:
+			return
+		case <-time.After(delay):
+		}
+		err := ordo.reestablish()
+		if err == nil {
+			break
+		}
+		log.Warningf("Could not reconnect to BOSSWAVE agent, retrying in %s (%s)", delay, err)
+		ordo.events.Publish(Error{Err: err})
+		if delay *= 2; delay > ordo.opts.reconnectMax {
+			delay = ordo.opts.reconnectMax
+		}
+	}
+
+	ordo.connLock.Lock()
+	ordo.reconnecting = false
+	ordo.connLock.Unlock()
+	log.Notice("Reconnected to BOSSWAVE agent")
+	ordo.events.Publish(ConnectionChanged{Connected: true})
+	// send what piled up while we were gone
+	ordo.outbox.kick()
+}
+
+// one attempt at getting a working connection and resubscribing the rooms not yet
+// subscribed on it. A connection made by an earlier attempt is kept unless it has
+// died too, so rooms that resubscribed then are not subscribed or announced again
+func (ordo *OrdoCore) reestablish() error {
+	ordo.connLock.RLock()
+	client, lost := ordo.bw, ordo.lost
+	ordo.connLock.RUnlock()
+	if client == lost {
+		fresh, vk, err := connect(&ordo.opts)
+		if err != nil {
+			return err
+		}
+		if vk != ordo.vk {
+			closeTransport(fresh)
+			return errors.New(fmt.Sprintf("Entity file %s now has VK %s, not %s", ordo.opts.entityFile, vk, ordo.vk))
+		}
+		ordo.connLock.Lock()
+		ordo.bw = fresh
+		ordo.connLock.Unlock()
+		// rooms still reading from it are resubscribed below
+		closeTransport(lost)
+		client = fresh
+	}
+
+	for _, room := range ordo.GetRooms() {
+		ctx, cancel := context.WithTimeout(context.Background(), resubscribeTimeout)
+		err := room.resubscribe(ctx, client)
+		cancel()
+		if err == nil {
+			continue
+		}
+		ctx, cancel = context.WithTimeout(context.Background(), livenessTimeout)
+		if pingErr := ordo.ping(ctx, client); pingErr != nil {
+			// the new connection has gone too, so the next attempt makes another
+			ordo.connLock.Lock()
+			ordo.lost = client
+			ordo.connLock.Unlock()
+		}
+		cancel()
+		return errors.Wrap(err, fmt.Sprintf("Could not resubscribe to room %s", room.URI))
+	}
+	return nil
+}
+
+// checks client still gets answers from the agent. Setting our entity again needs
+// no permissions, so unlike a publish it only fails if the agent is unreachable
+func (ordo *OrdoCore) ping(ctx context.Context, client Transport) error {
+	return withContext(ctx, func() error {
+		_, err := client.SetEntityFile(ordo.opts.entityFile)
+		return err
+	})
+}
+
+// asks for the connection to be checked now, as after a failed publish
+func (ordo *OrdoCore) checkConnection() {
+	select {
+	case ordo.checkNow <- struct{}{}:
+	default:
+	}
+}
+
+// checks the connection every liveness interval, or when asked to, until the core
+// is closed. A room's subscription closing also tells us the agent has gone, but
+// with no rooms joined nothing else would notice
+func (ordo *OrdoCore) watchConnection() {
+	for {
+		select {
+		case <-ordo.closed:
+			return
+		case <-ordo.checkNow:
+		case <-time.After(ordo.opts.liveness):
+		}
+		if !ordo.Connected() {
+			// already reconnecting
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), livenessTimeout)
+		err := ordo.ping(ctx, ordo.client())
+		cancel()
+		if err != nil {
+			ordo.connectionLost(errors.Wrap(err, "BOSSWAVE agent stopped answering"))
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// waits for cond to hold
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func reconnected(ev Event) bool {
+	changed, ok := ev.(ConnectionChanged)
+	return ok && changed.Connected
+}
+
+func TestFailedPublishNoticesLostAgent(t *testing.T) {
+	ordo, agent := newTestCore(t)
+	events := ordo.Subscribe(100, DropOldest)
+	defer events.Close()
+	ctx := context.Background()
+
+	first := agent.Conn()
+	first.Close()
+	if err := ordo.Post(ctx, testRoom, "lost"); err == nil {
+		t.Fatal("Posted on a closed connection")
+	}
+	waitForEvent(t, events, reconnected)
+	if agent.Conn() == first {
+		t.Fatal("Did not reconnect")
+	}
+	if err := ordo.Post(ctx, testRoom, "found"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLivenessCheckNoticesLostAgent(t *testing.T) {
+	ordo, agent := newTestCore(t, WithLivenessCheck(10*time.Millisecond))
+	events := ordo.Subscribe(100, DropOldest)
+	defer events.Close()
+	joinTestRoom(t, ordo)
+
+	// the subscription stays open, so only the liveness check notices
+	first := agent.Conn()
+	first.FailCalls(errRefused)
+	waitForEvent(t, events, reconnected)
+	if agent.Conn() == first {
+		t.Fatal("Did not reconnect")
+	}
+	if !first.Closed() {
+		t.Error("Replaced connection was not closed")
+	}
+	if n := agent.Subscriptions(); n != 1 {
+		t.Errorf("%d subscriptions open, want 1", n)
+	}
+}
+
+func TestReconnectResubscribesOnlyWhatFailed(t *testing.T) {
+	const otherRoom = "test.ns/room/other"
+	ordo, agent := newTestCore(t)
+	events := ordo.Subscribe(100, DropOldest)
+	defer events.Close()
+	joinTestRoom(t, ordo)
+	if _, err := ordo.JoinRoom(context.Background(), otherRoom); err != nil {
+		t.Fatal(err)
+	}
+
+	first := agent.Conn()
+	agent.FailSubscriptions(otherRoom, errRefused)
+	first.Close()
+	// the initial join and at least two failed attempts
+	eventually(t, "failed resubscribes", func() bool {
+		return countPublished(agent, otherRoom, JoinRoomPID) >= 3
+	})
+	agent.FailSubscriptions(otherRoom, nil)
+	waitForEvent(t, events, reconnected)
+
+	if n := len(agent.Conns()); n != 2 {
+		t.Errorf("Dialled %d connections, want 2", n)
+	}
+	if n := agent.Subscriptions(); n != 2 {
+		t.Errorf("%d subscriptions open, want 2", n)
+	}
+	if n := countPublished(agent, testRoom, JoinRoomPID); n != 2 {
+		t.Errorf("Announced in %s %d times, want 2", testRoom, n)
+	}
+}
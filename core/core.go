@@ -1,70 +1,132 @@
 package core
 
 import (
+	"context"
 	"fmt"
 	"github.com/op/go-logging"
+	"github.com/pkg/errors"
 	bw "gopkg.in/immesys/bw2bind.v5"
-	"os"
+	"strings"
 	"sync"
 )
 
-const (
-	RoomBufSize = 1000
-)
-
-var (
-	log    = logging.MustGetLogger("ordocore")
-	format = "%{color}%{level} %{time:Jan 02 15:04:05} %{shortfile}%{color:reset} ▶ %{message}"
-)
-
-func init() {
-	var logBackend = logging.NewLogBackend(os.Stderr, "", 0)
-	logBackendLeveled := logging.AddModuleLevel(logBackend)
-	logging.SetBackend(logBackendLeveled)
-	logging.SetFormatter(logging.MustStringFormatter(format))
-}
+// logs to the "ordocore" module. Programs embedding the core choose the backend
+var log = logging.MustGetLogger("ordocore")
 
 type OrdoCore struct {
-	// connection to bosswave
-	bw *bw.BW2Client
+	// how we were configured, kept for reconnecting
+	opts options
+	// protects bw, lost and reconnecting
+	connLock sync.RWMutex
+	// connection to bosswave. Replaced when we reconnect
+	bw Transport
+	// the last connection found dead. While bw is still this one, reconnecting
+	// needs a new connection rather than just resubscribing rooms
+	lost Transport
+	// whether the connection was lost and is being re-established
+	reconnecting bool
+	// prompts a liveness check of the connection
+	checkNow chan struct{}
+	// closed by Close to stop reconnecting
+	closed    chan struct{}
+	closeOnce sync.Once
 	// verifying key
 	vk string
 
 	roomsLock sync.RWMutex
 	rooms     map[string]*Room
 
-	// log of actions taken
-	Log chan string
-	// your name
-	Alias string
+	// where rooms publish what happens in them
+	events *EventBus
+	// our name
+	alias string
+	// messages buffered per room
+	roomBuf int
+	// messages queued by Room.Send
+	outbox *outbox
+	// orders messages across clients
+	clock Clock
 
-	// handlers
-	ReceivedJoin  func(msg JoinRoom)
-	ReceivedLeave func(msg LeaveRoom)
-	ReceivedChat  func(msg ChatMessage)
+	// decides which messages are mentions
+	matcher      *MentionMatcher
+	mentionsLock sync.RWMutex
+	mentions     []Message
 }
 
-func NewOrdoCore(entityfile, alias string) *OrdoCore {
+// connects to BOSSWAVE and returns a core ready to join rooms. WithEntityFile
+// is required
+func New(opts ...Option) (*OrdoCore, error) {
+	o := &options{
+		roomBuf:      DefaultRoomBufSize,
+		autoChain:    true,
+		reconnectMin: DefaultReconnectMin,
+		reconnectMax: DefaultReconnectMax,
+		liveness:     DefaultLivenessInterval,
+		dial:         dialAgent,
+	}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, errors.Wrap(err, "Invalid option")
+		}
+	}
+	if len(o.entityFile) == 0 {
+		return nil, errors.New("No entity file given")
+	}
+	client, vk, err := connect(o)
+	if err != nil {
+		return nil, err
+	}
+	if len(o.alias) == 0 {
+		o.alias = vk
+	}
+
 	ordo := &OrdoCore{
-		Log:   make(chan string, 100),
-		bw:    bw.ConnectOrExit(""),
-		rooms: make(map[string]*Room),
+		opts:     *o,
+		bw:       client,
+		closed:   make(chan struct{}),
+		checkNow: make(chan struct{}, 1),
+		vk:       vk,
+		rooms:    make(map[string]*Room),
+		events:   NewEventBus(),
+		alias:    o.alias,
+		roomBuf:  o.roomBuf,
+		matcher:  NewMentionMatcher(o.alias),
+	}
+	for _, keyword := range o.keywords {
+		ordo.matcher.AddKeyword(keyword)
+	}
+	for _, expr := range o.patterns {
+		if err := ordo.matcher.AddPattern(expr); err != nil {
+			return nil, err
+		}
+	}
+	if ordo.outbox, err = newOutbox(ordo, o.outboxFile); err != nil {
+		return nil, err
 	}
-	ordo.vk = ordo.bw.SetEntityFileOrExit(entityfile)
-	ordo.bw.OverrideAutoChainTo(true)
-	ordo.Alias = alias
-	ordo.log(ordo.Alias)
+	go ordo.outbox.run(ordo.closed)
+	go ordo.watchConnection()
+	return ordo, nil
+}
 
-	return ordo
+// returns the verifying key of the entity we are using
+func (ordo *OrdoCore) VK() string {
+	return ordo.vk
 }
 
-func (ordo *OrdoCore) log(s string) {
-	select {
-	case ordo.Log <- s:
-	default:
-		<-ordo.Log
-		ordo.Log <- s
-	}
+// returns the name others see us by
+func (ordo *OrdoCore) Alias() string {
+	return ordo.alias
+}
+
+// returns a subscription to events from all rooms. See EventBus.Subscribe
+func (ordo *OrdoCore) Subscribe(size int, policy Backpressure) *Subscription {
+	return ordo.events.Subscribe(size, policy)
+}
+
+// publishes an Error event for something that went wrong in room, which may be nil
+func (ordo *OrdoCore) reportError(room *Room, err error) {
+	log.Error(err)
+	ordo.events.Publish(Error{Room: room, Err: err})
 }
 
 // fills in the map with our current rooms
@@ -78,10 +140,43 @@ func (ordo *OrdoCore) GetRooms() []*Room {
 	return r
 }
 
+// returns the most recent mentions across all joined rooms, oldest first
+func (ordo *OrdoCore) GetMentions() []Message {
+	ordo.mentionsLock.RLock()
+	defer ordo.mentionsLock.RUnlock()
+	m := make([]Message, len(ordo.mentions))
+	copy(m, ordo.mentions)
+	return m
+}
+
+// highlight messages containing the given word (case insensitive) from now on
+func (ordo *OrdoCore) AddMentionKeyword(keyword string) {
+	ordo.matcher.AddKeyword(keyword)
+}
+
+// highlight messages matching the given regular expression from now on
+func (ordo *OrdoCore) AddMentionPattern(expr string) error {
+	return ordo.matcher.AddPattern(expr)
+}
+
+// returns true if the message text would be highlighted as a mention
+func (ordo *OrdoCore) IsMention(msg string) bool {
+	return ordo.matcher.Matches(msg)
+}
+
+func (ordo *OrdoCore) recordMention(msg Message) {
+	ordo.mentionsLock.Lock()
+	defer ordo.mentionsLock.Unlock()
+	if len(ordo.mentions) >= MentionLogSize {
+		ordo.mentions = ordo.mentions[1:]
+	}
+	ordo.mentions = append(ordo.mentions, msg)
+}
+
 // Join the chatroom at the given URI using alias as your nickname. Needs consume privileges to
 // listen in the room, and publish privileges to send messages to the room.
-// Returns true if the room was created for the first time
-func (ordo *OrdoCore) JoinRoom(roomURI string) (*Room, error) {
+// Rooms that were left are rejoined
+func (ordo *OrdoCore) JoinRoom(ctx context.Context, roomURI string) (*Room, error) {
 	var (
 		room  *Room
 		found bool
@@ -90,69 +185,177 @@ func (ordo *OrdoCore) JoinRoom(roomURI string) (*Room, error) {
 	ordo.roomsLock.Lock()
 	if room, found = ordo.rooms[roomURI]; !found {
 		// need to join the room
-		if room, err = NewRoom(roomURI, ordo, RoomBufSize); err != nil {
-			ordo.log(fmt.Sprintf("Could not join room (%s)", err.Error()))
+		if room, err = newRoom(roomURI, ordo, ordo.roomBuf); err != nil {
+			ordo.roomsLock.Unlock()
 			return nil, err
 		}
 		ordo.rooms[roomURI] = room
 	}
+	ordo.roomsLock.Unlock()
 
-	if !room.Alive {
-		ordo.log(fmt.Sprintf("room %s not alive so joining", room.URI))
-		if err = ordo.performJoin(room); err != nil {
-			ordo.log(fmt.Sprintf("Could not join room %s at URI %s (%s)", room.Name, room.URI, err.Error()))
-			return nil, err
+	if !room.IsAlive() {
+		if err = room.Join(ctx); err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("Could not join room %s at URI %s", room.Name, room.URI))
 		}
 	}
-	ordo.log(fmt.Sprintf("Joined room %s at URI %s", room.Name, room.URI))
-
-	ordo.roomsLock.Unlock()
 
 	return room, nil
 }
 
-func (ordo *OrdoCore) performJoin(room *Room) error {
-	joinRoom := JoinRoom{Alias: ordo.Alias}
-	err := ordo.bw.Publish(&bw.PublishParams{
-		URI:            room.URI,
-		PayloadObjects: []bw.PayloadObject{joinRoom.ToBW()},
+// sends a message to the room at roomURI without joining it, so the members are
+// not told we are there. Needs only publish permission on the room
+func (ordo *OrdoCore) Post(ctx context.Context, roomURI, msg string) error {
+	return ordo.performSpeak(ctx, roomURI, &ChatMessage{
+		Message: msg,
+		ID:      newMessageID(),
+		Clock:   ordo.clock.Now(),
 	})
-	if err != nil {
+}
+
+// leaves every joined room with the given reason and stops reconnecting. Returns
+// an error naming the rooms that could not be left
+func (ordo *OrdoCore) Close(ctx context.Context, reason string) error {
+	ordo.closeOnce.Do(func() { close(ordo.closed) })
+	var failed []string
+	for _, room := range ordo.GetRooms() {
+		if err := room.Leave(ctx, reason); err != nil {
+			failed = append(failed, fmt.Sprintf("%s (%s)", room.URI, err))
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New(fmt.Sprintf("Could not leave %s", strings.Join(failed, ", ")))
+	}
+	return nil
+}
+
+// returns the messages queued by Room.Send that have not been sent yet, oldest first
+func (ordo *OrdoCore) Outbox() []Outbound {
+	return ordo.outbox.list()
+}
+
+// queues failed messages to be sent again. With no IDs, retries every failed
+// message. Returns how many were queued
+func (ordo *OrdoCore) Retry(ids ...uint64) int {
+	return ordo.outbox.retry(ids)
+}
+
+// forgets failed messages. With no IDs, discards every failed message. Returns how
+// many were discarded
+func (ordo *OrdoCore) Discard(ids ...uint64) int {
+	return ordo.outbox.discard(ids)
+}
+
+// runs fxn, giving up when ctx is done. bw2 calls cannot be interrupted, so fxn
+// may still finish after we have returned
+func withContext(ctx context.Context, fxn func() error) error {
+	if err := ctx.Err(); err != nil {
 		return err
 	}
-	room.subscription, err = ordo.bw.Subscribe(&bw.SubscribeParams{
-		URI: room.URI,
+	result := make(chan error, 1)
+	go func() {
+		result <- fxn()
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// announces us in the room and subscribes to it on client, returning the
+// subscription and its handle
+func (ordo *OrdoCore) performJoin(ctx context.Context, client Transport, room *Room) (chan *bw.SimpleMessage, string, error) {
+	type subscription struct {
+		messages chan *bw.SimpleMessage
+		handle   string
+		err      error
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	result := make(chan subscription, 1)
+	go func() {
+		if !ordo.opts.quiet {
+			joinRoom := JoinRoom{Alias: ordo.alias}
+			err := client.Publish(&bw.PublishParams{
+				URI:            room.URI,
+				PayloadObjects: []bw.PayloadObject{joinRoom.ToBW()},
+			})
+			if err != nil {
+				result <- subscription{err: err}
+				return
+			}
+		}
+		messages, handle, err := client.SubscribeH(&bw.SubscribeParams{
+			URI: room.URI,
+		})
+		result <- subscription{messages, handle, err}
+	}()
+	select {
+	case sub := <-result:
+		if sub.err != nil {
+			ordo.checkConnection()
+		}
+		return sub.messages, sub.handle, sub.err
+	case <-ctx.Done():
+		// the subscription may still be made after we give up; drop it if so
+		go func() {
+			if sub := <-result; sub.err == nil {
+				client.Unsubscribe(sub.handle)
+			}
+		}()
+		ordo.checkConnection()
+		return nil, "", ctx.Err()
+	}
+}
+
+// publishes a chat message, which must already have its ID and Clock set
+func (ordo *OrdoCore) performSpeak(ctx context.Context, roomURI string, message *ChatMessage) error {
+	message.Alias = ordo.alias
+	err := withContext(ctx, func() error {
+		return ordo.client().Publish(&bw.PublishParams{
+			URI:            roomURI,
+			PayloadObjects: []bw.PayloadObject{message.ToBW()},
+		})
 	})
 	if err != nil {
-		return err
+		ordo.checkConnection()
+		return errors.Wrap(err, fmt.Sprintf("Could not send to room at URI %s", roomURI))
 	}
-	room.listen()
-	room.Alive = true
 	return nil
 }
 
-func (ordo *OrdoCore) performSpeak(room *Room, msg string) error {
-	message := &ChatMessage{Alias: ordo.Alias, Message: msg}
-	err := ordo.bw.Publish(&bw.PublishParams{
-		URI:            room.URI,
-		PayloadObjects: []bw.PayloadObject{message.ToBW()},
+func (ordo *OrdoCore) performSetTopic(ctx context.Context, room *Room, topic string) error {
+	msg := &SetTopic{Topic: topic, Alias: ordo.alias}
+	err := withContext(ctx, func() error {
+		return ordo.client().Publish(&bw.PublishParams{
+			URI:            room.URI,
+			PayloadObjects: []bw.PayloadObject{msg.ToBW()},
+			Persist:        true,
+		})
 	})
 	if err != nil {
-		ordo.log(fmt.Sprintf("Could not send to room %s at URI %s (%s)", room.Name, room.URI, err.Error()))
-		return err
+		ordo.checkConnection()
+		return errors.Wrap(err, fmt.Sprintf("Could not set topic of room %s at URI %s", room.Name, room.URI))
 	}
 	return nil
 }
 
-func (ordo *OrdoCore) performLeave(room *Room, reason string) error {
+func (ordo *OrdoCore) performLeave(ctx context.Context, room *Room, reason string) error {
+	if ordo.opts.quiet {
+		return nil
+	}
 	msg := &LeaveRoom{Reason: reason}
-	err := ordo.bw.Publish(&bw.PublishParams{
-		URI:            room.URI,
-		PayloadObjects: []bw.PayloadObject{msg.ToBW()},
+	err := withContext(ctx, func() error {
+		return ordo.client().Publish(&bw.PublishParams{
+			URI:            room.URI,
+			PayloadObjects: []bw.PayloadObject{msg.ToBW()},
+		})
 	})
 	if err != nil {
-		ordo.log(fmt.Sprintf("Could not send Leave to room %s at URI %s (%s)", room.Name, room.URI, err.Error()))
-		return err
+		ordo.checkConnection()
+		return errors.Wrap(err, fmt.Sprintf("Could not send Leave to room %s at URI %s", room.Name, room.URI))
 	}
 	return nil
 }
@@ -0,0 +1,270 @@
+/*
+Package coretest is an in-memory stand-in for a BOSSWAVE agent, for testing
+programs built on package core without running one:
+
+	agent := coretest.NewAgent("test-vk")
+	ordo, err := core.New(
+		core.WithEntityFile("test.ent"),
+		core.WithTransport(func(addr string) (core.Transport, error) {
+			conn, err := agent.Dial(addr)
+			if err != nil {
+				return nil, err
+			}
+			return conn, nil
+		}),
+	)
+
+Everything published through a connection is delivered to every subscription on
+the same URI, including the publisher's own, as the agent would. Permissions are
+not checked.
+*/
+package coretest
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	bw "gopkg.in/immesys/bw2bind.v5"
+	"sync"
+)
+
+// what a subscription channel can hold before delivery blocks
+const subscriptionBuffer = 1000
+
+// ErrClosed is returned by a connection after Close
+var ErrClosed = errors.New("Connection to agent closed")
+
+// Agent hands out connections and routes messages between them
+type Agent struct {
+	mu        sync.Mutex
+	vk        string
+	conns     []*Conn
+	published []bw.PublishParams
+	dialErr   error
+	// URIs that cannot be subscribed to, and why
+	subscribeErrs map[string]error
+}
+
+// returns an agent whose connections act as the entity with the given VK
+func NewAgent(vk string) *Agent {
+	return &Agent{vk: vk, subscribeErrs: make(map[string]error)}
+}
+
+// opens a new connection, unless FailDials has been given an error
+func (a *Agent) Dial(addr string) (*Conn, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.dialErr != nil {
+		return nil, a.dialErr
+	}
+	conn := &Conn{agent: a, subs: make(map[string]subscription)}
+	a.conns = append(a.conns, conn)
+	return conn, nil
+}
+
+// makes Dial fail with err until called again with nil
+func (a *Agent) FailDials(err error) {
+	a.mu.Lock()
+	a.dialErr = err
+	a.mu.Unlock()
+}
+
+// makes subscribing to uri fail with err until called again with nil
+func (a *Agent) FailSubscriptions(uri string, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err == nil {
+		delete(a.subscribeErrs, uri)
+	} else {
+		a.subscribeErrs[uri] = err
+	}
+}
+
+// returns every connection dialled so far, oldest first
+func (a *Agent) Conns() []*Conn {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]*Conn{}, a.conns...)
+}
+
+// the most recent connection
+func (a *Agent) Conn() *Conn {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.conns) == 0 {
+		return nil
+	}
+	return a.conns[len(a.conns)-1]
+}
+
+// returns what was published to uri, oldest first
+func (a *Agent) Published(uri string) []bw.PublishParams {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var found []bw.PublishParams
+	for _, params := range a.published {
+		if params.URI == uri {
+			found = append(found, params)
+		}
+	}
+	return found
+}
+
+// the number of open subscriptions across all connections
+func (a *Agent) Subscriptions() int {
+	count := 0
+	for _, conn := range a.Conns() {
+		conn.mu.Lock()
+		count += len(conn.subs)
+		conn.mu.Unlock()
+	}
+	return count
+}
+
+// delivers a message from the entity fromVK to every subscription on uri
+func (a *Agent) Inject(uri, fromVK string, pos ...bw.PayloadObject) {
+	for _, conn := range a.Conns() {
+		conn.deliver(&bw.SimpleMessage{From: fromVK, URI: uri, POs: pos})
+	}
+}
+
+type subscription struct {
+	uri      string
+	messages chan *bw.SimpleMessage
+}
+
+// Conn is one connection to an Agent. It implements core.Transport
+type Conn struct {
+	agent      *Agent
+	mu         sync.Mutex
+	subs       map[string]subscription
+	nextHandle int
+	closed     bool
+	publishErr error
+	// fails every call without closing anything
+	callErr error
+}
+
+func (c *Conn) SetEntityFile(path string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return "", ErrClosed
+	}
+	if c.callErr != nil {
+		return "", c.callErr
+	}
+	return c.agent.vk, nil
+}
+
+func (c *Conn) OverrideAutoChainTo(enabled bool) {}
+
+func (c *Conn) Publish(params *bw.PublishParams) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	if c.callErr != nil || c.publishErr != nil {
+		err := c.callErr
+		if err == nil {
+			err = c.publishErr
+		}
+		c.mu.Unlock()
+		return err
+	}
+	c.mu.Unlock()
+
+	c.agent.mu.Lock()
+	c.agent.published = append(c.agent.published, *params)
+	c.agent.mu.Unlock()
+	c.agent.Inject(params.URI, c.agent.vk, params.PayloadObjects...)
+	return nil
+}
+
+func (c *Conn) SubscribeH(params *bw.SubscribeParams) (chan *bw.SimpleMessage, string, error) {
+	c.agent.mu.Lock()
+	err := c.agent.subscribeErrs[params.URI]
+	c.agent.mu.Unlock()
+	if err != nil {
+		return nil, "", err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, "", ErrClosed
+	}
+	if c.callErr != nil {
+		return nil, "", c.callErr
+	}
+	c.nextHandle++
+	handle := fmt.Sprintf("sub-%d", c.nextHandle)
+	messages := make(chan *bw.SimpleMessage, subscriptionBuffer)
+	c.subs[handle] = subscription{uri: params.URI, messages: messages}
+	return messages, handle, nil
+}
+
+func (c *Conn) Unsubscribe(handle string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	if c.callErr != nil {
+		return c.callErr
+	}
+	sub, found := c.subs[handle]
+	if !found {
+		return errors.New(fmt.Sprintf("No subscription %s", handle))
+	}
+	close(sub.messages)
+	delete(c.subs, handle)
+	return nil
+}
+
+// makes Publish fail with err until called again with nil
+func (c *Conn) FailPublishes(err error) {
+	c.mu.Lock()
+	c.publishErr = err
+	c.mu.Unlock()
+}
+
+// makes every call fail with err until called again with nil, as if the agent
+// had stopped answering. Unlike Close, subscriptions stay open
+func (c *Conn) FailCalls(err error) {
+	c.mu.Lock()
+	c.callErr = err
+	c.mu.Unlock()
+}
+
+// closes the connection and its subscriptions, as if the agent had gone away.
+// Every call fails from now on
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	for handle, sub := range c.subs {
+		close(sub.messages)
+		delete(c.subs, handle)
+	}
+	return nil
+}
+
+// whether Close has been called
+func (c *Conn) Closed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func (c *Conn) deliver(msg *bw.SimpleMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, sub := range c.subs {
+		if sub.uri == msg.URI {
+			sub.messages <- msg
+		}
+	}
+}
@@ -0,0 +1,18 @@
+/*
+Package core is a client for ordo chat rooms on BOSSWAVE. It is what the bw2chat
+terminal client is built on, and can be embedded in other programs to post to and
+read from rooms.
+
+Connect with New, giving at least the entity to sign messages with. Posting to a
+room needs publish permission on its URI, and reading needs consume permission.
+Everything that happens in joined rooms is published as an Event; subscribe
+before joining so nothing is missed. See the examples for each.
+
+Programs built on core can be tested without an agent by passing WithTransport a
+connection from package coretest.
+
+A room also buffers the messages it receives until something tails it with
+StartTail, which is how the terminal client shows the backlog of a room when it
+is switched to.
+*/
+package core
@@ -0,0 +1,266 @@
+package core
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+type EventKind uint8
+
+const (
+	ChatReceivedEvent EventKind = iota
+	MemberJoinedEvent
+	MemberLeftEvent
+	RoomStateChangedEvent
+	ErrorEvent
+	ConnectionChangedEvent
+	OutboundChangedEvent
+	MemberRenamedEvent
+	TopicChangedEvent
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case ChatReceivedEvent:
+		return "chat"
+	case MemberJoinedEvent:
+		return "join"
+	case MemberLeftEvent:
+		return "leave"
+	case RoomStateChangedEvent:
+		return "state"
+	case ErrorEvent:
+		return "error"
+	case ConnectionChangedEvent:
+		return "connection"
+	case OutboundChangedEvent:
+		return "outbound"
+	case MemberRenamedEvent:
+		return "nick"
+	case TopicChangedEvent:
+		return "topic"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is something that happened in the core. Switch on the concrete type
+// (ChatReceived, MemberJoined, ...) to get at the details
+type Event interface {
+	Kind() EventKind
+}
+
+// a chat message arrived in a joined room
+type ChatReceived struct {
+	Message Message
+}
+
+// someone announced themselves in a joined room
+type MemberJoined struct {
+	Room   *Room
+	Member Member
+}
+
+// someone left a joined room
+type MemberLeft struct {
+	Room   *Room
+	Member Member
+	Reason string
+}
+
+// someone in a joined room started using a different alias
+type MemberRenamed struct {
+	Room     *Room
+	Member   Member
+	OldAlias string
+}
+
+// the topic of a joined room was set, or we were told it on joining
+type TopicChanged struct {
+	Room  *Room
+	Topic string
+	// alias of whoever set the topic
+	By string
+}
+
+// a room's unread counts, members or liveness changed
+type RoomStateChanged struct {
+	State RoomState
+}
+
+// something went wrong. Room is nil if the error was not specific to a room
+type Error struct {
+	Room *Room
+	Err  error
+}
+
+// the connection to the BOSSWAVE agent went up or down. Err says why it went down
+type ConnectionChanged struct {
+	Connected bool
+	Err       error
+}
+
+// a message queued with Room.Send was queued, sent, failed or discarded
+type OutboundChanged struct {
+	Item Outbound
+}
+
+// the descriptions below are what rooms queue for display
+
+func (ev MemberJoined) String() string {
+	return fmt.Sprintf("%s joined", ev.Member.Alias)
+}
+
+func (ev MemberLeft) String() string {
+	if len(ev.Reason) > 0 {
+		return fmt.Sprintf("%s left (%s)", ev.Member.Alias, ev.Reason)
+	}
+	return fmt.Sprintf("%s left", ev.Member.Alias)
+}
+
+func (ev MemberRenamed) String() string {
+	return fmt.Sprintf("%s is now known as %s", ev.OldAlias, ev.Member.Alias)
+}
+
+func (ev TopicChanged) String() string {
+	return fmt.Sprintf("%s set the topic to: %s", ev.By, ev.Topic)
+}
+
+func (ChatReceived) Kind() EventKind      { return ChatReceivedEvent }
+func (MemberJoined) Kind() EventKind      { return MemberJoinedEvent }
+func (MemberLeft) Kind() EventKind        { return MemberLeftEvent }
+func (RoomStateChanged) Kind() EventKind  { return RoomStateChangedEvent }
+func (Error) Kind() EventKind             { return ErrorEvent }
+func (ConnectionChanged) Kind() EventKind { return ConnectionChangedEvent }
+func (OutboundChanged) Kind() EventKind   { return OutboundChangedEvent }
+func (MemberRenamed) Kind() EventKind     { return MemberRenamedEvent }
+func (TopicChanged) Kind() EventKind      { return TopicChangedEvent }
+
+// what happens to an event when a subscriber's buffer is full
+type Backpressure uint8
+
+const (
+	// discard the oldest buffered event to make room. Good for UIs, which only
+	// care about what is recent
+	DropOldest Backpressure = iota
+	// discard the new event
+	DropNewest
+	// wait until the subscriber has room. A slow subscriber holds up the rooms
+	// publishing to it, so use this only for consumers that must see everything
+	Block
+)
+
+// EventBus fans events out to any number of subscribers, each with its own
+// buffer and backpressure policy
+type EventBus struct {
+	mu          sync.RWMutex
+	subscribers map[*Subscription]struct{}
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[*Subscription]struct{})}
+}
+
+// a subscriber's view of an EventBus. Events arrive on C, which is closed by Close
+type Subscription struct {
+	C <-chan Event
+
+	events   chan Event
+	policy   Backpressure
+	bus      *EventBus
+	lock     sync.Mutex
+	closed   bool
+	done     chan struct{}
+	stopOnce sync.Once
+	// number of events thrown away because the buffer was full
+	dropped uint64
+}
+
+// returns a subscription to every event published from now on, buffering up to
+// size events
+func (bus *EventBus) Subscribe(size int, policy Backpressure) *Subscription {
+	if size < 1 && policy != Block {
+		// dropping needs somewhere to drop from
+		size = 1
+	}
+	events := make(chan Event, size)
+	sub := &Subscription{
+		C:      events,
+		events: events,
+		policy: policy,
+		bus:    bus,
+		done:   make(chan struct{}),
+	}
+	bus.mu.Lock()
+	bus.subscribers[sub] = struct{}{}
+	bus.mu.Unlock()
+	return sub
+}
+
+// delivers the event to every subscriber according to its policy
+func (bus *EventBus) Publish(ev Event) {
+	bus.mu.RLock()
+	subs := make([]*Subscription, 0, len(bus.subscribers))
+	for sub := range bus.subscribers {
+		subs = append(subs, sub)
+	}
+	bus.mu.RUnlock()
+	for _, sub := range subs {
+		sub.deliver(ev)
+	}
+}
+
+func (sub *Subscription) deliver(ev Event) {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	if sub.closed {
+		return
+	}
+	switch sub.policy {
+	case Block:
+		select {
+		case sub.events <- ev:
+		case <-sub.done:
+		}
+	case DropNewest:
+		select {
+		case sub.events <- ev:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	default:
+		for {
+			select {
+			case sub.events <- ev:
+				return
+			default:
+			}
+			select {
+			case <-sub.events:
+				atomic.AddUint64(&sub.dropped, 1)
+			default:
+			}
+		}
+	}
+}
+
+// returns how many events this subscriber has missed because its buffer was full
+func (sub *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&sub.dropped)
+}
+
+// stops delivery and closes C. Safe to call more than once
+func (sub *Subscription) Close() {
+	// unblocks a publisher waiting on a full buffer before we take the lock
+	sub.stopOnce.Do(func() { close(sub.done) })
+	sub.bus.mu.Lock()
+	delete(sub.bus.subscribers, sub)
+	sub.bus.mu.Unlock()
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	if !sub.closed {
+		sub.closed = true
+		close(sub.events)
+	}
+}
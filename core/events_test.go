@@ -0,0 +1,175 @@
+package core
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// an event that can be told apart from the others
+func numbered(n uint64) Event {
+	return OutboundChanged{Item: Outbound{ID: n}}
+}
+
+// the numbers of the events buffered in sub, oldest first
+func drain(sub *Subscription) []uint64 {
+	var found []uint64
+	for {
+		select {
+		case ev := <-sub.C:
+			found = append(found, ev.(OutboundChanged).Item.ID)
+		default:
+			return found
+		}
+	}
+}
+
+func TestEventBusPolicies(t *testing.T) {
+	for _, test := range []struct {
+		policy  Backpressure
+		size    int
+		want    []uint64
+		dropped uint64
+	}{
+		{DropOldest, 2, []uint64{4, 5}, 3},
+		{DropNewest, 2, []uint64{1, 2}, 3},
+		{DropOldest, 10, []uint64{1, 2, 3, 4, 5}, 0},
+		{DropNewest, 10, []uint64{1, 2, 3, 4, 5}, 0},
+		// too small to drop from, so treated as 1
+		{DropOldest, 0, []uint64{5}, 4},
+		{DropNewest, 0, []uint64{1}, 4},
+	} {
+		bus := NewEventBus()
+		sub := bus.Subscribe(test.size, test.policy)
+		for n := uint64(1); n <= 5; n++ {
+			bus.Publish(numbered(n))
+		}
+		name := fmt.Sprintf("policy %d, size %d", test.policy, test.size)
+		if got := drain(sub); fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s: received %v, want %v", name, got, test.want)
+		}
+		if n := sub.Dropped(); n != test.dropped {
+			t.Errorf("%s: dropped %d, want %d", name, n, test.dropped)
+		}
+		sub.Close()
+	}
+}
+
+// publishes n in the background, returning a channel closed once Publish returns
+func publishAsync(bus *EventBus, n uint64) chan struct{} {
+	published := make(chan struct{})
+	go func() {
+		bus.Publish(numbered(n))
+		close(published)
+	}()
+	return published
+}
+
+func TestEventBusBlock(t *testing.T) {
+	bus := NewEventBus()
+	sub := bus.Subscribe(1, Block)
+	defer sub.Close()
+	bus.Publish(numbered(1))
+
+	published := publishAsync(bus, 2)
+	select {
+	case <-published:
+		t.Fatal("Publish did not wait for a full subscriber")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if ev := <-sub.C; ev.(OutboundChanged).Item.ID != 1 {
+		t.Errorf("Received %+v, want event 1", ev)
+	}
+	select {
+	case <-published:
+	case <-time.After(testTimeout):
+		t.Fatal("Publish still waiting after the subscriber made room")
+	}
+	if got := drain(sub); fmt.Sprint(got) != "[2]" {
+		t.Errorf("Received %v, want [2]", got)
+	}
+	if n := sub.Dropped(); n != 0 {
+		t.Errorf("Dropped %d events, want 0", n)
+	}
+}
+
+func TestEventBusCloseUnblocksPublisher(t *testing.T) {
+	bus := NewEventBus()
+	sub := bus.Subscribe(1, Block)
+	bus.Publish(numbered(1))
+	published := publishAsync(bus, 2)
+	time.Sleep(10 * time.Millisecond)
+
+	sub.Close()
+	select {
+	case <-published:
+	case <-time.After(testTimeout):
+		t.Fatal("Publish still waiting after Close")
+	}
+	for range sub.C {
+		// C is closed once drained
+	}
+}
+
+func TestEventBusUnsubscribe(t *testing.T) {
+	bus := NewEventBus()
+	gone := bus.Subscribe(10, DropOldest)
+	kept := bus.Subscribe(10, Block)
+	defer kept.Close()
+
+	bus.Publish(numbered(1))
+	gone.Close()
+	gone.Close()
+	bus.Publish(numbered(2))
+
+	var received []uint64
+	for ev := range gone.C {
+		received = append(received, ev.(OutboundChanged).Item.ID)
+	}
+	if fmt.Sprint(received) != "[1]" {
+		t.Errorf("Closed subscriber received %v, want [1]", received)
+	}
+	if got := drain(kept); fmt.Sprint(got) != "[1 2]" {
+		t.Errorf("Remaining subscriber received %v, want [1 2]", got)
+	}
+	bus.mu.RLock()
+	n := len(bus.subscribers)
+	bus.mu.RUnlock()
+	if n != 1 {
+		t.Errorf("%d subscribers, want 1", n)
+	}
+}
+
+func TestEventBusConcurrent(t *testing.T) {
+	bus := NewEventBus()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := uint64(0); n < 100; n++ {
+				bus.Publish(numbered(n))
+			}
+		}(i)
+	}
+	for _, policy := range []Backpressure{DropOldest, DropNewest, Block} {
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(policy Backpressure) {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					sub := bus.Subscribe(2, policy)
+					drain(sub)
+					sub.Close()
+				}
+			}(policy)
+		}
+	}
+	wg.Wait()
+	bus.mu.RLock()
+	defer bus.mu.RUnlock()
+	if n := len(bus.subscribers); n != 0 {
+		t.Errorf("%d subscribers left after closing them all", n)
+	}
+}
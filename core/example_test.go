@@ -0,0 +1,104 @@
+package core_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/gtfierro/ordo/core"
+	"github.com/gtfierro/ordo/core/coretest"
+	"log"
+	"time"
+)
+
+// Connect with New, giving at least the entity to sign messages with
+func ExampleNew() {
+	ordo, err := core.New(
+		core.WithEntityFile("bot.ent"),
+		core.WithAlias("deploybot"),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer ordo.Close(context.Background(), "shutting down")
+}
+
+// Posting to a room needs publish permission on its URI
+func ExampleRoom_Speak() {
+	ordo, err := core.New(core.WithEntityFile("bot.ent"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer ordo.Close(context.Background(), "")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	room, err := ordo.JoinRoom(ctx, "scratch.ns/room/deploys")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := room.Speak(ctx, "deployed v1.2.3"); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Reading needs consume permission. Subscribe before joining so nothing is missed
+func ExampleOrdoCore_Subscribe() {
+	ordo, err := core.New(core.WithEntityFile("bot.ent"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer ordo.Close(context.Background(), "")
+
+	sub := ordo.Subscribe(100, core.Block)
+	defer sub.Close()
+	if _, err := ordo.JoinRoom(context.Background(), "scratch.ns/room/deploys"); err != nil {
+		log.Fatal(err)
+	}
+	for ev := range sub.C {
+		switch ev := ev.(type) {
+		case core.ChatReceived:
+			fmt.Printf("%s: %s\n", ev.Message.From, ev.Message.Message)
+		case core.MemberJoined:
+			fmt.Printf("%s joined %s\n", ev.Member.Alias, ev.Room.Name)
+		case core.Error:
+			fmt.Println(ev.Err)
+		}
+	}
+}
+
+// Tests can stand in for the agent with package coretest
+func ExampleWithTransport() {
+	agent := coretest.NewAgent("bot-vk")
+	ordo, err := core.New(
+		core.WithEntityFile("bot.ent"),
+		core.WithAlias("deploybot"),
+		core.WithTransport(func(addr string) (core.Transport, error) {
+			conn, err := agent.Dial(addr)
+			if err != nil {
+				return nil, err
+			}
+			return conn, nil
+		}),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer ordo.Close(context.Background(), "")
+
+	sub := ordo.Subscribe(100, core.Block)
+	defer sub.Close()
+	ctx := context.Background()
+	room, err := ordo.JoinRoom(ctx, "scratch.ns/room/deploys")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := room.Speak(ctx, "deployed v1.2.3"); err != nil {
+		log.Fatal(err)
+	}
+	for ev := range sub.C {
+		if chat, ok := ev.(core.ChatReceived); ok {
+			fmt.Printf("%s: %s\n", chat.Message.From, chat.Message.Message)
+			break
+		}
+	}
+	// Output: deploybot: deployed v1.2.3
+}
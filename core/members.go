@@ -0,0 +1,96 @@
+package core
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	// members heard from within IdleAfter are online
+	IdleAfter = 5 * time.Minute
+	// members not heard from within AwayAfter are away
+	AwayAfter = 30 * time.Minute
+)
+
+type Presence uint8
+
+const (
+	Online Presence = iota
+	Idle
+	Away
+)
+
+func (p Presence) String() string {
+	switch p {
+	case Online:
+		return "online"
+	case Idle:
+		return "idle"
+	case Away:
+		return "away"
+	default:
+		return "unknown"
+	}
+}
+
+type Role uint8
+
+const (
+	MemberRole Role = iota
+	// the member is us
+	SelfRole
+)
+
+func (r Role) String() string {
+	switch r {
+	case MemberRole:
+		return "member"
+	case SelfRole:
+		return "self"
+	default:
+		return "unknown"
+	}
+}
+
+// a user known to be in a room
+type Member struct {
+	VK    string
+	Alias string
+	Role  Role
+	// when we last received anything from this member
+	LastSeen time.Time
+}
+
+// presence is derived from how long ago we last heard from the member
+func (m Member) Presence(now time.Time) Presence {
+	if m.Role == SelfRole {
+		return Online
+	}
+	switch since := now.Sub(m.LastSeen); {
+	case since < IdleAfter:
+		return Online
+	case since < AwayAfter:
+		return Idle
+	default:
+		return Away
+	}
+}
+
+// a short, readable digest of the member's VK for comparing identities
+func (m Member) Fingerprint() string {
+	sum := sha256.Sum256([]byte(m.VK))
+	return fmt.Sprintf("%x:%x:%x:%x", sum[0:2], sum[2:4], sum[4:6], sum[6:8])
+}
+
+// sorts members by presence, then alias
+func sortMembers(members []Member, now time.Time) {
+	sort.Slice(members, func(i, j int) bool {
+		pi, pj := members[i].Presence(now), members[j].Presence(now)
+		if pi != pj {
+			return pi < pj
+		}
+		return members[i].Alias < members[j].Alias
+	})
+}
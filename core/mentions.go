@@ -0,0 +1,63 @@
+package core
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	MentionLogSize = 100 // remember the last 100 mentions across all rooms
+)
+
+// decides whether or not a chat message should be highlighted for the user.
+// A message is a mention if it contains the user's alias or any of the
+// registered keywords as a whole word, or matches any of the registered patterns
+type MentionMatcher struct {
+	mu    sync.RWMutex
+	rules []*regexp.Regexp
+}
+
+func NewMentionMatcher(alias string) *MentionMatcher {
+	mm := &MentionMatcher{}
+	mm.AddKeyword(alias)
+	return mm
+}
+
+// highlight messages containing the given word (case insensitive). Blank keywords
+// are ignored, since they would match every message
+func (mm *MentionMatcher) AddKeyword(keyword string) {
+	keyword = strings.TrimSpace(keyword)
+	if len(keyword) == 0 {
+		return
+	}
+	// not \b, which has no edge to match next to punctuation like the @ of @ops
+	re := regexp.MustCompile(`(?i)(^|\W)` + regexp.QuoteMeta(keyword) + `($|\W)`)
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.rules = append(mm.rules, re)
+}
+
+// highlight messages matching the given regular expression
+func (mm *MentionMatcher) AddPattern(expr string) error {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return err
+	}
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.rules = append(mm.rules, re)
+	return nil
+}
+
+// returns true if the message should be highlighted
+func (mm *MentionMatcher) Matches(msg string) bool {
+	mm.mu.RLock()
+	defer mm.mu.RUnlock()
+	for _, re := range mm.rules {
+		if re.MatchString(msg) {
+			return true
+		}
+	}
+	return false
+}
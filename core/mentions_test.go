@@ -0,0 +1,62 @@
+package core
+
+import (
+	"testing"
+)
+
+func TestMentionMatcher(t *testing.T) {
+	mm := NewMentionMatcher("bob")
+	for _, keyword := range []string{"@ops", "c++", "deploy.", "", "  "} {
+		mm.AddKeyword(keyword)
+	}
+	if err := mm.AddPattern(`^!page\b`); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		msg  string
+		want bool
+	}{
+		{"hi bob", true},
+		{"Bob: lunch?", true},
+		{"BOB!", true},
+		{"(bob)", true},
+		{"bobby tables", false},
+		{"kabob", false},
+		{"@ops the build is red", true},
+		{"ping @OPS", true},
+		{"ops is fine", false},
+		{"@opsteam", false},
+		{"written in c++", true},
+		{"c++11", false},
+		{"running deploy.", true},
+		{"deploy. done", true},
+		{"deploy.sh failed", false},
+		{"redeploy.", false},
+		{"!page oncall", true},
+		{"no !page here", false},
+		{"nothing to see", false},
+		{"", false},
+	} {
+		if got := mm.Matches(test.msg); got != test.want {
+			t.Errorf("Matches(%q) = %t, want %t", test.msg, got, test.want)
+		}
+	}
+}
+
+func TestMentionMatcherNoAlias(t *testing.T) {
+	mm := NewMentionMatcher("")
+	mm.AddKeyword("")
+	if mm.Matches("anything at all") {
+		t.Error("Blank keywords matched a message")
+	}
+}
+
+func TestMentionMatcherBadPattern(t *testing.T) {
+	mm := NewMentionMatcher("bob")
+	if err := mm.AddPattern("("); err == nil {
+		t.Error("Added an invalid pattern")
+	}
+	if mm.Matches("(") {
+		t.Error("Invalid pattern matched")
+	}
+}
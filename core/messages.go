@@ -2,24 +2,31 @@ package core
 
 import (
 	bw "gopkg.in/immesys/bw2bind.v5"
+	"time"
 )
 
 const (
 	ChatMessagePIDString = "2.0.7.2"
 	JoinRoomPIDString    = "2.0.7.3"
 	LeaveRoomPIDString   = "2.0.7.4"
+	SetTopicPIDString    = "2.0.7.5"
 )
 
 var (
 	ChatMessagePID = bw.FromDotForm("2.0.7.2")
 	JoinRoomPID    = bw.FromDotForm("2.0.7.3")
 	LeaveRoomPID   = bw.FromDotForm("2.0.7.4")
+	SetTopicPID    = bw.FromDotForm("2.0.7.5")
 )
 
 type ChatMessage struct {
 	// the message to send to the chatroom
 	Message string
 	Alias   string
+	// random ID so copies of the message can be recognized. Empty from older clients
+	ID string
+	// sender's Clock timestamp, for ordering. Zero from older clients
+	Clock uint64
 }
 
 func (msg ChatMessage) ToBW() bw.PayloadObject {
@@ -53,9 +60,63 @@ func (msg LeaveRoom) ToBW() bw.PayloadObject {
 	return po
 }
 
+// sets the topic of a room. Published with persist set, so that anyone joining
+// later is told the topic when they subscribe
+type SetTopic struct {
+	Topic string
+	// who set the topic
+	Alias string
+}
+
+func (msg SetTopic) ToBW() bw.PayloadObject {
+	po, _ := bw.CreateMsgPackPayloadObject(SetTopicPID, msg)
+	return po
+}
+
+// what a Message in a room's queue is
+type MessageKind uint8
+
+const (
+	// something someone said
+	ChatKind MessageKind = iota
+	// the events below are generated from the room's traffic and their Message
+	// describes what happened
+	JoinKind
+	LeaveKind
+	// someone started using a different alias
+	NickKind
+	TopicKind
+)
+
+func (k MessageKind) String() string {
+	switch k {
+	case ChatKind:
+		return "chat"
+	case JoinKind:
+		return "join"
+	case LeaveKind:
+		return "leave"
+	case NickKind:
+		return "nick"
+	case TopicKind:
+		return "topic"
+	default:
+		return "unknown"
+	}
+}
+
 type Message struct {
+	Kind    MessageKind
 	Message string
 	FromVK  string
 	From    string
 	Room    *Room
+	// the sender's ID for the message, if it gave one
+	ID string
+	// Clock timestamp to order the message by
+	Clock uint64
+	// when the message was received
+	Time time.Time
+	// true if the message matched the mention rules
+	Mention bool
 }
@@ -0,0 +1,154 @@
+package core
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"time"
+)
+
+const (
+	// messages buffered per room while nobody is tailing it
+	DefaultRoomBufSize = 1000
+)
+
+type options struct {
+	agent      string
+	entityFile string
+	alias      string
+	roomBuf    int
+	autoChain  bool
+	keywords   []string
+	patterns   []string
+	// bounds on the wait between attempts to reconnect
+	reconnectMin time.Duration
+	reconnectMax time.Duration
+	// how often to check the agent still answers
+	liveness time.Duration
+	// where Room.Send keeps unsent messages
+	outboxFile string
+	// join and leave rooms without telling their members
+	quiet bool
+	// opens a connection to the agent
+	dial func(addr string) (Transport, error)
+}
+
+// Option configures an OrdoCore created with New
+type Option func(*options) error
+
+// connect to the BOSSWAVE agent at addr instead of $BW2_AGENT or the local default
+func WithAgent(addr string) Option {
+	return func(o *options) error {
+		o.agent = addr
+		return nil
+	}
+}
+
+// use the entity in the given file to sign messages. Required
+func WithEntityFile(path string) Option {
+	return func(o *options) error {
+		if len(path) == 0 {
+			return errors.New("Entity file must not be empty")
+		}
+		o.entityFile = path
+		return nil
+	}
+}
+
+// the name others see us by. Defaults to the VK of our entity
+func WithAlias(alias string) Option {
+	return func(o *options) error {
+		o.alias = alias
+		return nil
+	}
+}
+
+// how many received messages each room keeps while nobody is tailing it
+func WithRoomBuffer(size int) Option {
+	return func(o *options) error {
+		if size < 1 {
+			return errors.New("Room buffer must hold at least one message")
+		}
+		o.roomBuf = size
+		return nil
+	}
+}
+
+// whether to let the agent build permission chains for us. On by default
+func WithAutoChain(enabled bool) Option {
+	return func(o *options) error {
+		o.autoChain = enabled
+		return nil
+	}
+}
+
+// treat messages containing any of the keywords as mentions, as well as our alias
+func WithMentionKeywords(keywords ...string) Option {
+	return func(o *options) error {
+		o.keywords = append(o.keywords, keywords...)
+		return nil
+	}
+}
+
+// treat messages matching any of the regular expressions as mentions
+func WithMentionPatterns(exprs ...string) Option {
+	return func(o *options) error {
+		o.patterns = append(o.patterns, exprs...)
+		return nil
+	}
+}
+
+// how long to wait between attempts to reconnect after losing the agent. The wait
+// starts at min and doubles after each failure, up to max
+func WithReconnectBackoff(min, max time.Duration) Option {
+	return func(o *options) error {
+		if min <= 0 || max < min {
+			return errors.New(fmt.Sprintf("Invalid reconnect backoff %s to %s", min, max))
+		}
+		o.reconnectMin = min
+		o.reconnectMax = max
+		return nil
+	}
+}
+
+// how often to check that the agent still answers, which is how a lost
+// connection is noticed when no room is joined. Failed publishes prompt a check
+// straight away. Defaults to DefaultLivenessInterval
+func WithLivenessCheck(interval time.Duration) Option {
+	return func(o *options) error {
+		if interval <= 0 {
+			return errors.New(fmt.Sprintf("Invalid liveness check interval %s", interval))
+		}
+		o.liveness = interval
+		return nil
+	}
+}
+
+// keep messages queued by Room.Send in the given file until they are sent, so
+// they are not lost if the program exits first. Without this they are kept in memory
+func WithOutboxFile(path string) Option {
+	return func(o *options) error {
+		o.outboxFile = path
+		return nil
+	}
+}
+
+// join and leave rooms without announcing it, for programs that only listen.
+// Others in the room do not see us in their member lists
+func WithQuietPresence() Option {
+	return func(o *options) error {
+		o.quiet = true
+		return nil
+	}
+}
+
+// connect with dial instead of to a BOSSWAVE agent. dial is called with the agent
+// address on startup and whenever the core reconnects
+func WithTransport(dial func(addr string) (Transport, error)) Option {
+	return func(o *options) error {
+		if dial == nil {
+			return errors.New("Transport dialer must not be nil")
+		}
+		o.dial = dial
+		return nil
+	}
+}
@@ -0,0 +1,296 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// attempts at sending a message before it is marked failed
+	OutboxMaxAttempts = 5
+	// how often pending messages are retried when nothing else prompts it
+	OutboxRetryInterval = 10 * time.Second
+	// how long a single attempt at sending may take
+	outboxSendTimeout = 10 * time.Second
+)
+
+type OutboundState uint8
+
+const (
+	// waiting to be sent, or being sent
+	Pending OutboundState = iota
+	// published to the room
+	Sent
+	// gave up after OutboxMaxAttempts. Later messages to the same room wait until
+	// Retry puts it back in the queue or Discard throws it away
+	Failed
+	// thrown away by Discard
+	Discarded
+)
+
+func (s OutboundState) String() string {
+	switch s {
+	case Pending:
+		return "pending"
+	case Sent:
+		return "sent"
+	case Failed:
+		return "failed"
+	case Discarded:
+		return "discarded"
+	default:
+		return "unknown"
+	}
+}
+
+// a message queued by Room.Send
+type Outbound struct {
+	ID uint64 `json:"id"`
+	// the ID the message is sent with, so its echo can be recognized
+	MessageID string        `json:"message_id"`
+	Clock     uint64        `json:"clock"`
+	RoomURI   string        `json:"room"`
+	Message   string        `json:"message"`
+	Queued    time.Time     `json:"queued"`
+	Attempts  int           `json:"attempts"`
+	State     OutboundState `json:"state"`
+	// why the last attempt failed
+	LastError string `json:"last_error,omitempty"`
+}
+
+// outbox holds messages until they are published, sending them in order. Unsent
+// messages are kept in a file, if given one, so they survive restarts
+type outbox struct {
+	sync.Mutex
+	path   string
+	nextID uint64
+	items  []*Outbound
+	// prompts the sender to try again now
+	wake chan struct{}
+	ordo *OrdoCore
+}
+
+// loads unsent messages from path, which may be empty to keep them in memory only
+func newOutbox(ordo *OrdoCore, path string) (*outbox, error) {
+	o := &outbox{path: path, nextID: 1, wake: make(chan struct{}, 1), ordo: ordo}
+	if len(path) == 0 {
+		return o, nil
+	}
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return o, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Could not read outbox %s", path))
+	}
+	if err := json.Unmarshal(contents, &o.items); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Could not parse outbox %s", path))
+	}
+	for _, item := range o.items {
+		if item.ID >= o.nextID {
+			o.nextID = item.ID + 1
+		}
+		if len(item.MessageID) == 0 {
+			item.MessageID = newMessageID()
+		}
+		ordo.clock.Observe(item.Clock)
+	}
+	return o, nil
+}
+
+// must be called with the lock held
+func (o *outbox) save() error {
+	if len(o.path) == 0 {
+		return nil
+	}
+	contents, err := json.MarshalIndent(o.items, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Could not encode outbox")
+	}
+	if err := os.MkdirAll(filepath.Dir(o.path), 0700); err != nil {
+		return errors.Wrap(err, "Could not create outbox directory")
+	}
+	tmp := o.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, contents, 0600); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("Could not write outbox %s", tmp))
+	}
+	return os.Rename(tmp, o.path)
+}
+
+// saves, then tells subscribers about the changed items. Must be called with the lock held
+func (o *outbox) changed(items ...*Outbound) {
+	if err := o.save(); err != nil {
+		o.ordo.reportError(nil, err)
+	}
+	for _, item := range items {
+		o.ordo.events.Publish(OutboundChanged{Item: *item})
+	}
+}
+
+func (o *outbox) kick() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (o *outbox) enqueue(roomURI, msg string) Outbound {
+	o.Lock()
+	item := &Outbound{
+		ID:        o.nextID,
+		MessageID: newMessageID(),
+		Clock:     o.ordo.clock.Now(),
+		RoomURI:   roomURI,
+		Message:   msg,
+		Queued:    time.Now(),
+		State:     Pending,
+	}
+	o.nextID++
+	o.items = append(o.items, item)
+	o.changed(item)
+	// the sender updates item once we unlock
+	queued := *item
+	o.Unlock()
+	o.kick()
+	return queued
+}
+
+// returns copies of the unsent messages, oldest first
+func (o *outbox) list() []Outbound {
+	o.Lock()
+	defer o.Unlock()
+	items := make([]Outbound, len(o.items))
+	for i, item := range o.items {
+		items[i] = *item
+	}
+	return items
+}
+
+// returns the failed messages with the given IDs, or all of them if none are given.
+// Must be called with the lock held
+func (o *outbox) failed(ids []uint64) []*Outbound {
+	var found []*Outbound
+	for _, item := range o.items {
+		if item.State != Failed {
+			continue
+		}
+		if len(ids) == 0 {
+			found = append(found, item)
+			continue
+		}
+		for _, id := range ids {
+			if item.ID == id {
+				found = append(found, item)
+			}
+		}
+	}
+	return found
+}
+
+// puts failed messages back in the queue with a fresh set of attempts
+func (o *outbox) retry(ids []uint64) int {
+	o.Lock()
+	items := o.failed(ids)
+	for _, item := range items {
+		item.State = Pending
+		item.Attempts = 0
+	}
+	o.changed(items...)
+	o.Unlock()
+	o.kick()
+	return len(items)
+}
+
+// forgets failed messages
+func (o *outbox) discard(ids []uint64) int {
+	o.Lock()
+	defer o.Unlock()
+	items := o.failed(ids)
+	for _, item := range items {
+		item.State = Discarded
+		o.remove(item)
+	}
+	o.changed(items...)
+	return len(items)
+}
+
+// must be called with the lock held
+func (o *outbox) remove(item *Outbound) {
+	for i, other := range o.items {
+		if other == item {
+			o.items = append(o.items[:i], o.items[i+1:]...)
+			return
+		}
+	}
+}
+
+// sends queued messages whenever prompted, or every OutboxRetryInterval, until done is closed
+func (o *outbox) run(done chan struct{}) {
+	for {
+		o.flush()
+		select {
+		case <-done:
+			return
+		case <-o.wake:
+		case <-time.After(OutboxRetryInterval):
+		}
+	}
+}
+
+// tries each pending message in order, stopping at the first failure so that
+// messages to a room are not reordered. Messages queued behind a Failed message
+// to the same room wait until it is retried or discarded
+func (o *outbox) flush() {
+	for {
+		if !o.ordo.Connected() {
+			// retried once we reconnect
+			return
+		}
+		o.Lock()
+		var item *Outbound
+		blocked := make(map[string]bool)
+		for _, candidate := range o.items {
+			if candidate.State == Failed {
+				blocked[candidate.RoomURI] = true
+			} else if candidate.State == Pending && !blocked[candidate.RoomURI] {
+				item = candidate
+				break
+			}
+		}
+		if item == nil {
+			o.Unlock()
+			return
+		}
+		uri := item.RoomURI
+		msg := &ChatMessage{Message: item.Message, ID: item.MessageID, Clock: item.Clock}
+		o.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), outboxSendTimeout)
+		err := o.ordo.performSpeak(ctx, uri, msg)
+		cancel()
+
+		o.Lock()
+		item.Attempts++
+		if err == nil {
+			item.State = Sent
+			o.remove(item)
+		} else {
+			item.LastError = err.Error()
+			if item.Attempts >= OutboxMaxAttempts {
+				item.State = Failed
+			}
+		}
+		o.changed(item)
+		stalled := item.State == Pending
+		o.Unlock()
+		if stalled {
+			return
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"github.com/gtfierro/ordo/core/coretest"
+	"github.com/pkg/errors"
+	bw "gopkg.in/immesys/bw2bind.v5"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var errRefused = errors.New("publish refused")
+
+// prompts the outbox until the message with the given ID reaches state
+func waitForOutbound(t *testing.T, ordo *OrdoCore, events *Subscription, id uint64, state OutboundState) Outbound {
+	t.Helper()
+	timeout := time.After(testTimeout)
+	for {
+		ordo.outbox.kick()
+		select {
+		case ev := <-events.C:
+			if changed, ok := ev.(OutboundChanged); ok && changed.Item.ID == id && changed.Item.State == state {
+				return changed.Item
+			}
+		case <-timeout:
+			t.Fatalf("Message %d never became %s", id, state)
+		}
+	}
+}
+
+// queues a message that fails every attempt at sending
+func failedMessage(t *testing.T, ordo *OrdoCore, agent *coretest.Agent, events *Subscription) Outbound {
+	t.Helper()
+	room := joinTestRoom(t, ordo)
+	agent.Conn().FailPublishes(errRefused)
+	item := room.Send("hello")
+	return waitForOutbound(t, ordo, events, item.ID, Failed)
+}
+
+func TestOutboxFailsAfterMaxAttempts(t *testing.T) {
+	ordo, agent := newTestCore(t)
+	events := ordo.Subscribe(100, DropOldest)
+	defer events.Close()
+
+	item := failedMessage(t, ordo, agent, events)
+	if item.Attempts != OutboxMaxAttempts {
+		t.Errorf("Failed after %d attempts, want %d", item.Attempts, OutboxMaxAttempts)
+	}
+	if len(item.LastError) == 0 {
+		t.Error("Failed message has no error")
+	}
+	if n := countPublished(agent, testRoom, ChatMessagePID); n != 0 {
+		t.Errorf("%d chat messages published, want 0", n)
+	}
+	if outbox := ordo.Outbox(); len(outbox) != 1 || outbox[0].State != Failed {
+		t.Errorf("Outbox holds %+v, want the failed message", outbox)
+	}
+}
+
+func TestOutboxRetry(t *testing.T) {
+	ordo, agent := newTestCore(t)
+	events := ordo.Subscribe(100, DropOldest)
+	defer events.Close()
+	item := failedMessage(t, ordo, agent, events)
+
+	if n := ordo.Retry(item.ID + 1); n != 0 {
+		t.Errorf("Retried %d messages with an unknown ID, want 0", n)
+	}
+	agent.Conn().FailPublishes(nil)
+	if n := ordo.Retry(item.ID); n != 1 {
+		t.Fatalf("Retried %d messages, want 1", n)
+	}
+	waitForOutbound(t, ordo, events, item.ID, Sent)
+	if outbox := ordo.Outbox(); len(outbox) != 0 {
+		t.Errorf("Outbox holds %+v after sending", outbox)
+	}
+	if n := countPublished(agent, testRoom, ChatMessagePID); n != 1 {
+		t.Errorf("%d chat messages published, want 1", n)
+	}
+}
+
+func TestOutboxDiscard(t *testing.T) {
+	ordo, agent := newTestCore(t)
+	events := ordo.Subscribe(100, DropOldest)
+	defer events.Close()
+	item := failedMessage(t, ordo, agent, events)
+
+	if n := ordo.Discard(); n != 1 {
+		t.Fatalf("Discarded %d messages, want 1", n)
+	}
+	waitForOutbound(t, ordo, events, item.ID, Discarded)
+	if outbox := ordo.Outbox(); len(outbox) != 0 {
+		t.Errorf("Outbox holds %+v after discarding", outbox)
+	}
+	if n := ordo.Retry(item.ID); n != 0 {
+		t.Errorf("Retried %d discarded messages, want 0", n)
+	}
+}
+
+func TestOutboxPersistence(t *testing.T) {
+	// not held back by the failed message
+	const otherRoom = "test.ns/room/other"
+	path := filepath.Join(t.TempDir(), "outbox.json")
+	ordo, agent := newTestCore(t, WithOutboxFile(path))
+	events := ordo.Subscribe(100, DropOldest)
+	defer events.Close()
+	room, err := ordo.JoinRoom(context.Background(), otherRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := failedMessage(t, ordo, agent, events)
+	ordo.Close(context.Background(), "")
+	// queued once nothing is sending, so it stays as saved
+	pending := room.Send("still trying")
+	saved := ordo.Outbox()
+
+	loaded, err := newOutbox(ordo, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := loaded.list()
+	if len(items) != len(saved) {
+		t.Fatalf("Loaded %d messages, want %d", len(items), len(saved))
+	}
+	for i, item := range items {
+		want := saved[i]
+		if item.ID != want.ID || item.MessageID != want.MessageID || item.Clock != want.Clock ||
+			item.RoomURI != want.RoomURI || item.Message != want.Message || item.State != want.State ||
+			item.Attempts != want.Attempts || item.LastError != want.LastError || !item.Queued.Equal(want.Queued) {
+			t.Errorf("Loaded %+v, want %+v", item, want)
+		}
+	}
+	if next := loaded.enqueue(otherRoom, "new"); next.ID <= pending.ID {
+		t.Errorf("New message reuses ID %d", next.ID)
+	}
+
+	// a later run sends what is pending and keeps what failed
+	restarted, agent := newTestCore(t, WithOutboxFile(path))
+	deadline := time.Now().Add(testTimeout)
+	for {
+		outbox := restarted.Outbox()
+		if len(outbox) == 1 && outbox[0].ID == failed.ID {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Outbox holds %+v after restarting, want only the failed message", outbox)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := countPublished(agent, otherRoom, ChatMessagePID); n != 2 {
+		t.Errorf("%d chat messages published after restarting, want 2", n)
+	}
+}
+
+// the chat messages published to uri, oldest first
+func publishedChat(t *testing.T, agent *coretest.Agent, uri string) []string {
+	t.Helper()
+	var found []string
+	for _, params := range agent.Published(uri) {
+		for _, po := range params.PayloadObjects {
+			if po.GetPONum() != ChatMessagePID {
+				continue
+			}
+			var msg ChatMessage
+			if err := po.(bw.MsgPackPayloadObject).ValueInto(&msg); err != nil {
+				t.Fatal(err)
+			}
+			found = append(found, msg.Message)
+		}
+	}
+	return found
+}
+
+func TestOutboxFailedHoldsBackRoom(t *testing.T) {
+	const otherRoom = "test.ns/room/other"
+	ordo, agent := newTestCore(t)
+	events := ordo.Subscribe(100, DropOldest)
+	defer events.Close()
+	other, err := ordo.JoinRoom(context.Background(), otherRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := failedMessage(t, ordo, agent, events)
+	agent.Conn().FailPublishes(nil)
+
+	later := joinTestRoom(t, ordo).Send("later")
+	elsewhere := other.Send("elsewhere")
+	waitForOutbound(t, ordo, events, elsewhere.ID, Sent)
+	// another round, in case the later message was going to be sent after all
+	ordo.outbox.flush()
+	for _, item := range ordo.Outbox() {
+		if item.ID == later.ID && item.State != Pending {
+			t.Errorf("Later message %s, want pending", item.State)
+		}
+	}
+	if sent := publishedChat(t, agent, testRoom); len(sent) != 0 {
+		t.Fatalf("Sent %q past a failed message", sent)
+	}
+
+	ordo.Retry(failed.ID)
+	waitForOutbound(t, ordo, events, later.ID, Sent)
+	if sent := publishedChat(t, agent, testRoom); fmt.Sprint(sent) != "[hello later]" {
+		t.Errorf("Sent %q, want hello then later", sent)
+	}
+}
+
+func TestOutboxDiscardReleasesRoom(t *testing.T) {
+	ordo, agent := newTestCore(t)
+	events := ordo.Subscribe(100, DropOldest)
+	defer events.Close()
+	failedMessage(t, ordo, agent, events)
+	agent.Conn().FailPublishes(nil)
+
+	later := joinTestRoom(t, ordo).Send("later")
+	ordo.Discard()
+	waitForOutbound(t, ordo, events, later.ID, Sent)
+	if sent := publishedChat(t, agent, testRoom); fmt.Sprint(sent) != "[later]" {
+		t.Errorf("Sent %q, want only later", sent)
+	}
+}
@@ -1,56 +1,75 @@
 package core
 
 import (
+	"context"
 	"fmt"
 	"github.com/pkg/errors"
 	bw "gopkg.in/immesys/bw2bind.v5"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
-// represents an Ordo chat room
+// represents an Ordo chat room. While joined, a single goroutine owns the room's
+// subscription and queue of undisplayed messages; it is cancelled by Leave and
+// a new one is started if the room is joined again
 type Room struct {
-	// buffer of received but not displayed messages
-	buffer chan Message
 	// URI of the room
 	URI string
 	// name of room derived from URI
 	Name string
-	// your name in the room
-	Alias string
+
+	// serializes Join, Leave, resubscribing and tail changes
+	lifecycle sync.Mutex
+	// protects alive, tail, cancel, done, subHandle and subClient
+	lock sync.Mutex
 	// whether or not the room can be used
-	Alive bool
-	// internal signal to leave the room
-	quit chan bool
-	// internal signal to stop tailing
-	stoptail chan bool
+	alive bool
+	// where to deliver queued messages. nil when not tailing
+	tail chan Message
+	// hands the room goroutine a change of tail. Unbuffered, so once a send
+	// completes the goroutine is no longer delivering to the old tail
+	tailChanged chan struct{}
+	// stops the room goroutine
+	cancel context.CancelFunc
+	// closed when the room goroutine exits
+	done chan struct{}
+	// identifies our subscription to bw2 so it can be dropped on Leave
+	subHandle string
+	// the connection the subscription was made on
+	subClient Transport
+	// topic of the room, once someone has set it. Protected by lock
+	topic string
+	// hands the room goroutine a new subscription after reconnecting
+	resubscribed chan chan *bw.SimpleMessage
 
-	// callback when the room's state updates
-	updateState func(state RoomState)
+	// received but not displayed messages. Only touched by the room goroutine
+	pending []Message
+	bufsize int
 
 	// number of unread messages
 	unreadMsgCount int32
-	// number of known users
-	knownUserCount int32
-	// map of known user VKs to aliases
-	knownUsers map[string]string
+	// number of unread mentions (not included in unreadMsgCount)
+	unreadMentionCount int32
+	// who is in the room
+	users *roster
+	// IDs of recent messages, to drop copies. Only touched by the room goroutine
+	seen *idWindow
 
 	// reference to core
 	ordo *OrdoCore
-	// channel of incoming chat room messages
-	subscription chan *bw.SimpleMessage
 }
 
-func NewRoom(roomURI string, ordo *OrdoCore, bufsize int) (*Room, error) {
+func newRoom(roomURI string, ordo *OrdoCore, bufsize int) (*Room, error) {
 	room := &Room{
-		buffer:      make(chan Message, bufsize),
-		URI:         roomURI,
-		Alive:       false,
-		stoptail:    make(chan bool, 1),
-		quit:        make(chan bool),
-		updateState: func(state RoomState) {},
-		knownUsers:  map[string]string{ordo.vk: ordo.Alias},
-		ordo:        ordo,
+		URI:          roomURI,
+		tailChanged:  make(chan struct{}),
+		resubscribed: make(chan chan *bw.SimpleMessage),
+		bufsize:      bufsize,
+		users:        newRoster(ordo.vk, ordo.alias),
+		seen:         newIDWindow(DedupWindow),
+		ordo:         ordo,
 	}
 	if idx := strings.LastIndex(roomURI, "/"); idx > 0 {
 		room.Name = roomURI[strings.LastIndex(roomURI, "/"):]
@@ -60,141 +79,432 @@ func NewRoom(roomURI string, ordo *OrdoCore, bufsize int) (*Room, error) {
 	return room, nil
 }
 
-// function to be invoked when the room's state changes
-func (room *Room) SetStateUpdateCallback(fxn func(state RoomState)) {
-	room.updateState = fxn
+// whether or not the room is joined
+func (room *Room) IsAlive() bool {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+	return room.alive
+}
+
+// returns the aliases of the users currently known to be in the room
+func (room *Room) Aliases() []string {
+	users := room.users.snapshot()
+	aliases := make([]string, 0, len(users))
+	for _, alias := range users {
+		aliases = append(aliases, alias)
+	}
+	return aliases
 }
 
 // join the room. Sends a JoinMessage to all subscribers and
-// subscribes to the room
-func (room *Room) Join() error {
-	if !room.Alive {
-		return room.ordo.performJoin(room)
+// subscribes to the room. Joining a room that was left rejoins it,
+// keeping any messages that had not been displayed. Gives up when ctx is done
+func (room *Room) Join(ctx context.Context) error {
+	room.lifecycle.Lock()
+	defer room.lifecycle.Unlock()
+	if room.IsAlive() {
+		return nil
 	}
+	client := room.ordo.client()
+	sub, handle, err := room.ordo.performJoin(ctx, client, room)
+	if err != nil {
+		return err
+	}
+	// who was here when we left is no longer known
+	room.users.reset()
+	// the room outlives the join call, so it gets a context of its own
+	runCtx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	room.lock.Lock()
+	room.alive = true
+	room.cancel = cancel
+	room.done = done
+	room.subHandle = handle
+	room.subClient = client
+	room.lock.Unlock()
+	go room.run(runCtx, sub, done)
+	room.publishState()
 	return nil
 }
 
-func (room *Room) Leave(reason string) error {
-	room.Alive = false
-	if err := room.ordo.performLeave(room, reason); err != nil {
+// leave the room, telling the other members why. Stops the room goroutine and
+// drops our subscription even if ctx is done before the others could be told.
+// Leaving a room that is not joined does nothing
+func (room *Room) Leave(ctx context.Context, reason string) error {
+	room.lifecycle.Lock()
+	defer room.lifecycle.Unlock()
+	room.lock.Lock()
+	if !room.alive {
+		room.lock.Unlock()
+		return nil
+	}
+	room.alive = false
+	cancel, done, handle, client := room.cancel, room.done, room.subHandle, room.subClient
+	room.cancel, room.done, room.subHandle, room.subClient = nil, nil, "", nil
+	room.lock.Unlock()
+
+	err := room.ordo.performLeave(ctx, room, reason)
+	cancel()
+	<-done
+	// a subscription on a connection that is dead or replaced went with it
+	if room.ordo.usable(client) {
+		unsubErr := withContext(ctx, func() error { return client.Unsubscribe(handle) })
+		if unsubErr != nil && err == nil {
+			err = unsubErr
+		}
+	}
+	room.publishState()
+	return err
+}
+
+// subscribes on client after the core has reconnected, announcing us to the room
+// again since the others may have missed us while we were gone. Does nothing if
+// the room is already subscribed on client
+func (room *Room) resubscribe(ctx context.Context, client Transport) error {
+	room.lifecycle.Lock()
+	defer room.lifecycle.Unlock()
+	room.lock.Lock()
+	done := !room.alive || room.subClient == client
+	room.lock.Unlock()
+	if done {
+		return nil
+	}
+	sub, handle, err := room.ordo.performJoin(ctx, client, room)
+	if err != nil {
 		return err
 	}
-	room.quit <- true
-	close(room.subscription)
-	close(room.buffer)
+	room.lock.Lock()
+	room.subHandle = handle
+	room.subClient = client
+	room.lock.Unlock()
+	// the room goroutine only exits on Leave, which waits for lifecycle
+	room.resubscribed <- sub
 	return nil
 }
 
-func (room *Room) Speak(msg string) error {
-	return room.ordo.performSpeak(room, msg)
+// send a message to the room. Gives up when ctx is done
+func (room *Room) Speak(ctx context.Context, msg string) error {
+	if !room.IsAlive() {
+		return errors.New(fmt.Sprintf("Not in room %s", room.URI))
+	}
+	return room.ordo.performSpeak(ctx, room.URI, &ChatMessage{
+		Message: msg,
+		ID:      newMessageID(),
+		Clock:   room.ordo.clock.Now(),
+	})
+}
+
+// returns the topic of the room, or "" if we have not been told it
+func (room *Room) Topic() string {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+	return room.topic
+}
+
+// sets the topic of the room for everyone in it and everyone who joins later
+func (room *Room) SetTopic(ctx context.Context, topic string) error {
+	if !room.IsAlive() {
+		return errors.New(fmt.Sprintf("Not in room %s", room.URI))
+	}
+	return room.ordo.performSetTopic(ctx, room, topic)
+}
+
+// queues a message for the room, to be sent in order with anything queued
+// before it and retried if the agent cannot be reached. Progress is published as
+// OutboundChanged events
+func (room *Room) Send(msg string) Outbound {
+	return room.ordo.outbox.enqueue(room.URI, msg)
 }
 
+// deliver received messages to dest, replacing any previous destination
 func (room *Room) StartTail(dest chan Message) {
-	go func(dest chan Message) {
-		for {
-			select {
-			case <-room.stoptail:
-				return
-			case msg := <-room.buffer:
-				dest <- Message{From: msg.From, Room: room, Message: msg.Message}
-				atomic.AddInt32(&room.unreadMsgCount, -1)
-				room.getState()
-			}
-		}
-	}(dest)
+	room.setTail(dest)
 }
 
+// stop delivering received messages. Nothing is delivered to the old destination
+// once this returns. Safe to call when not tailing
 func (room *Room) StopTail() {
-	room.stoptail <- true
+	room.setTail(nil)
 }
 
-func (room *Room) newMessage(msg Message) {
-	if !room.Alive {
+// waits for the room goroutine, if there is one, to take up dest
+func (room *Room) setTail(dest chan Message) {
+	// keeps the goroutine from starting or stopping underneath us
+	room.lifecycle.Lock()
+	defer room.lifecycle.Unlock()
+	room.lock.Lock()
+	room.tail = dest
+	done := room.done
+	room.lock.Unlock()
+	if done == nil {
+		// the next goroutine starts with dest
 		return
 	}
 	select {
-	case room.buffer <- msg:
-		atomic.AddInt32(&room.unreadMsgCount, 1)
-		room.getState()
-	default:
-		<-room.buffer
-		room.buffer <- msg
-		atomic.AddInt32(&room.unreadMsgCount, 1)
+	case room.tailChanged <- struct{}{}:
+	case <-done:
 	}
 }
 
-func (room *Room) listen() {
-	go func() {
+func (room *Room) tailDest() chan Message {
+	room.lock.Lock()
+	defer room.lock.Unlock()
+	return room.tail
+}
+
+// the room goroutine: handles incoming bw2 messages and feeds queued messages to
+// the tail destination until ctx is cancelled
+func (room *Room) run(ctx context.Context, sub chan *bw.SimpleMessage, done chan struct{}) {
+	defer close(done)
+	dest := room.tailDest()
+	for {
 		var (
-			chatMessage  ChatMessage
-			joinMessage  JoinRoom
-			leaveMessage LeaveRoom
+			out  chan Message
+			next Message
 		)
-		for {
-			select {
-			case <-room.quit:
-				return
-			case msg := <-room.subscription:
-				for _, po := range msg.POs {
-					if po.IsType(ChatMessagePID, ChatMessagePID) {
-						err := po.(bw.MsgPackPayloadObject).ValueInto(&chatMessage)
-						if err != nil {
-							log.Error(errors.Wrap(err, "Could not parse chat msg"))
-						}
-						if len(chatMessage.Message) == 0 {
-							continue
-						}
-						if _, found := room.knownUsers[msg.From]; !found {
-							room.knownUsers[msg.From] = chatMessage.Alias
-						}
-						room.newMessage(Message{
-							Message: chatMessage.Message,
-							FromVK:  msg.From,
-							From:    room.knownUsers[msg.From],
-							Room:    room,
-						})
-						room.getState()
-					} else if po.IsType(JoinRoomPID, JoinRoomPID) {
-						err := po.(bw.MsgPackPayloadObject).ValueInto(&joinMessage)
-						if err != nil {
-							log.Error(errors.Wrap(err, "Could not parse join msg"))
-						}
-						room.knownUsers[msg.From] = joinMessage.Alias
-						atomic.AddInt32(&room.knownUserCount, 1)
-						room.getState()
-					} else if po.IsType(LeaveRoomPID, LeaveRoomPID) {
-						err := po.(bw.MsgPackPayloadObject).ValueInto(&leaveMessage)
-						if err != nil {
-							log.Error(errors.Wrap(err, "Could not parse leave msg"))
-						}
-						delete(room.knownUsers, msg.From)
-						atomic.AddInt32(&room.knownUserCount, -1)
-						room.getState()
-					}
-				}
+		if dest != nil && len(room.pending) > 0 {
+			out, next = dest, room.pending[0]
+			next.Room = room
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-room.tailChanged:
+			dest = room.tailDest()
+		case msg, ok := <-sub:
+			if !ok {
+				// the agent has probably gone away. Keep the queue and wait for
+				// the core to reconnect and give us a new subscription
+				sub = nil
+				room.ordo.connectionLost(errors.New(fmt.Sprintf("Subscription to room %s closed", room.URI)))
+				continue
+			}
+			room.handle(msg)
+		case sub = <-room.resubscribed:
+		case out <- next:
+			room.pending = room.pending[1:]
+			room.markRead(next)
+			room.publishState()
+		}
+	}
+}
+
+// queues a message for display, dropping the oldest if the queue is full
+func (room *Room) newMessage(msg Message) {
+	if msg.Mention {
+		room.ordo.recordMention(msg)
+	}
+	if msg.Kind == ChatKind {
+		room.ordo.events.Publish(ChatReceived{Message: msg})
+	}
+	if len(room.pending) >= room.bufsize {
+		room.markRead(room.pending[0])
+		room.pending = room.pending[1:]
+	}
+	// keep the queue in clock order; messages usually arrive in order, so look from the end
+	idx := len(room.pending)
+	for idx > 0 && room.pending[idx-1].Clock > msg.Clock {
+		idx--
+	}
+	room.pending = append(room.pending, Message{})
+	copy(room.pending[idx+1:], room.pending[idx:])
+	room.pending[idx] = msg
+	room.markUnread(msg)
+	room.publishState()
+}
+
+// queues a description of something that happened in the room
+func (room *Room) newEvent(kind MessageKind, fromVK, from, text string) {
+	room.newMessage(Message{
+		Kind:    kind,
+		Message: text,
+		FromVK:  fromVK,
+		From:    from,
+		Room:    room,
+		Clock:   room.ordo.clock.Now(),
+		Time:    time.Now(),
+	})
+}
+
+// events don't count as unread
+func (room *Room) markUnread(msg Message) {
+	if msg.Kind != ChatKind {
+		return
+	}
+	if msg.Mention {
+		atomic.AddInt32(&room.unreadMentionCount, 1)
+	} else {
+		atomic.AddInt32(&room.unreadMsgCount, 1)
+	}
+}
+
+func (room *Room) markRead(msg Message) {
+	if msg.Kind != ChatKind {
+		return
+	}
+	if msg.Mention {
+		decrementToZero(&room.unreadMentionCount)
+	} else {
+		decrementToZero(&room.unreadMsgCount)
+	}
+}
+
+// clears the unread and mention counts without consuming the buffered messages
+func (room *Room) MarkRead() {
+	atomic.StoreInt32(&room.unreadMsgCount, 0)
+	atomic.StoreInt32(&room.unreadMentionCount, 0)
+	room.publishState()
+}
+
+// counts may already have been cleared by MarkRead, so never go below zero
+func decrementToZero(count *int32) {
+	for {
+		old := atomic.LoadInt32(count)
+		if old <= 0 || atomic.CompareAndSwapInt32(count, old, old-1) {
+			return
+		}
+	}
+}
+
+// tells everyone that vk now goes by a different alias
+func (room *Room) renamed(vk, previous, alias string) {
+	member := Member{VK: vk, Alias: alias}
+	for _, m := range room.users.members() {
+		if m.VK == vk {
+			member = m
+		}
+	}
+	ev := MemberRenamed{Room: room, Member: member, OldAlias: previous}
+	room.ordo.events.Publish(ev)
+	room.newEvent(NickKind, vk, alias, ev.String())
+}
+
+// handles one message from the room's subscription
+func (room *Room) handle(msg *bw.SimpleMessage) {
+	var (
+		joinMessage  JoinRoom
+		leaveMessage LeaveRoom
+	)
+	for _, po := range msg.POs {
+		if po.IsType(ChatMessagePID, ChatMessagePID) {
+			var chatMessage ChatMessage
+			err := po.(bw.MsgPackPayloadObject).ValueInto(&chatMessage)
+			if err != nil {
+				room.ordo.reportError(room, errors.Wrap(err, "Could not parse chat msg"))
+			}
+			if len(chatMessage.Message) == 0 {
+				continue
+			}
+			// we see every message again when it is redelivered after resubscribing
+			if len(chatMessage.ID) > 0 && !room.seen.add(chatMessage.ID) {
+				continue
+			}
+			if chatMessage.Clock > 0 {
+				room.ordo.clock.Observe(chatMessage.Clock)
+			} else {
+				// older clients don't send a clock, so order by arrival
+				chatMessage.Clock = room.ordo.clock.Now()
+			}
+			if previous := room.users.seen(msg.From, chatMessage.Alias); len(previous) > 0 && previous != chatMessage.Alias {
+				room.renamed(msg.From, previous, chatMessage.Alias)
+			}
+			room.newMessage(Message{
+				Message: chatMessage.Message,
+				FromVK:  msg.From,
+				From:    chatMessage.Alias,
+				Room:    room,
+				ID:      chatMessage.ID,
+				Clock:   chatMessage.Clock,
+				Time:    time.Now(),
+				Mention: msg.From != room.ordo.vk && room.ordo.IsMention(chatMessage.Message),
+			})
+		} else if po.IsType(JoinRoomPID, JoinRoomPID) {
+			err := po.(bw.MsgPackPayloadObject).ValueInto(&joinMessage)
+			if err != nil {
+				room.ordo.reportError(room, errors.Wrap(err, "Could not parse join msg"))
+			}
+			member, previous := room.users.join(msg.From, joinMessage.Alias)
+			ev := MemberJoined{Room: room, Member: member}
+			room.ordo.events.Publish(ev)
+			if len(previous) > 0 && previous != joinMessage.Alias {
+				room.renamed(msg.From, previous, joinMessage.Alias)
+			}
+			room.newEvent(JoinKind, msg.From, joinMessage.Alias, ev.String())
+		} else if po.IsType(LeaveRoomPID, LeaveRoomPID) {
+			err := po.(bw.MsgPackPayloadObject).ValueInto(&leaveMessage)
+			if err != nil {
+				room.ordo.reportError(room, errors.Wrap(err, "Could not parse leave msg"))
+			}
+			member := room.users.leave(msg.From)
+			if len(member.Alias) == 0 {
+				// left before we heard anything from them
+				member.Alias = member.Fingerprint()
 			}
+			ev := MemberLeft{Room: room, Member: member, Reason: leaveMessage.Reason}
+			room.ordo.events.Publish(ev)
+			room.newEvent(LeaveKind, msg.From, member.Alias, ev.String())
+		} else if po.IsType(SetTopicPID, SetTopicPID) {
+			var topicMessage SetTopic
+			err := po.(bw.MsgPackPayloadObject).ValueInto(&topicMessage)
+			if err != nil {
+				room.ordo.reportError(room, errors.Wrap(err, "Could not parse topic msg"))
+				continue
+			}
+			room.lock.Lock()
+			unchanged := room.topic == topicMessage.Topic
+			room.topic = topicMessage.Topic
+			room.lock.Unlock()
+			if unchanged {
+				// we are told the persisted topic again whenever we resubscribe
+				continue
+			}
+			ev := TopicChanged{Room: room, Topic: topicMessage.Topic, By: topicMessage.Alias}
+			room.ordo.events.Publish(ev)
+			room.newEvent(TopicKind, msg.From, topicMessage.Alias, ev.String())
 		}
-	}()
+	}
 }
 
+// a snapshot of a room, as carried by RoomStateChanged. The map and
+// slice are copies, so the snapshot can be kept and read from any goroutine
 type RoomState struct {
 	NumUnreadMessages int32
+	NumUnreadMentions int32
 	NumCurrentUsers   int32
+	URI               string
 	Name              string
 	CurrentUsers      map[string]string
-	Room              *Room
-}
-
-func (state RoomState) Height() int {
-	return 5 + len(state.CurrentUsers)
+	// known users sorted by presence, then alias
+	Members []Member
+	Topic   string
+	Room    *Room
+	// false once the room has been left
+	Alive bool
 }
 
-func (room *Room) getState() {
-	room.updateState(RoomState{
+// returns a snapshot of the room's current state
+func (room *Room) State() RoomState {
+	// the count and the map come from the same copy as Members so they agree
+	members := room.users.members()
+	users := make(map[string]string, len(members))
+	for _, member := range members {
+		users[member.VK] = member.Alias
+	}
+	return RoomState{
 		NumUnreadMessages: atomic.LoadInt32(&room.unreadMsgCount),
-		NumCurrentUsers:   atomic.LoadInt32(&room.knownUserCount),
+		NumUnreadMentions: atomic.LoadInt32(&room.unreadMentionCount),
+		NumCurrentUsers:   int32(len(members)),
+		URI:               room.URI,
 		Name:              room.Name,
-		CurrentUsers:      room.knownUsers,
+		CurrentUsers:      users,
+		Members:           members,
+		Topic:             room.Topic(),
 		Room:              room,
-	})
+		Alive:             room.IsAlive(),
+	}
+}
+
+// publishes a snapshot of the room's state
+func (room *Room) publishState() {
+	room.ordo.events.Publish(RoomStateChanged{State: room.State()})
 }
@@ -0,0 +1,283 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"github.com/gtfierro/ordo/core/coretest"
+	bw "gopkg.in/immesys/bw2bind.v5"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testVK   = "test-vk"
+	otherVK  = "other-vk"
+	testRoom = "test.ns/room/general"
+	// how long to wait for something that should happen promptly
+	testTimeout = 5 * time.Second
+)
+
+// returns a core connected to a fake agent, closed when the test ends
+func newTestCore(t *testing.T, opts ...Option) (*OrdoCore, *coretest.Agent) {
+	t.Helper()
+	agent := coretest.NewAgent(testVK)
+	opts = append([]Option{
+		WithEntityFile("test.ent"),
+		WithAlias("tester"),
+		WithReconnectBackoff(time.Millisecond, 10*time.Millisecond),
+		WithTransport(func(addr string) (Transport, error) {
+			conn, err := agent.Dial(addr)
+			if err != nil {
+				return nil, err
+			}
+			return conn, nil
+		}),
+	}, opts...)
+	ordo, err := New(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ordo.Close(context.Background(), "") })
+	return ordo, agent
+}
+
+func joinTestRoom(t *testing.T, ordo *OrdoCore) *Room {
+	t.Helper()
+	room, err := ordo.JoinRoom(context.Background(), testRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return room
+}
+
+func chat(id, text string) bw.PayloadObject {
+	return ChatMessage{Message: text, Alias: "other", ID: id}.ToBW()
+}
+
+// how many of the messages published to uri carry a payload with the given PID
+func countPublished(agent *coretest.Agent, uri string, pid int) int {
+	count := 0
+	for _, params := range agent.Published(uri) {
+		for _, po := range params.PayloadObjects {
+			if po.GetPONum() == pid {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+func receive(t *testing.T, messages chan Message) Message {
+	t.Helper()
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(testTimeout):
+		t.Fatal("No message received")
+		return Message{}
+	}
+}
+
+// waits for an event that passes match
+func waitForEvent(t *testing.T, sub *Subscription, match func(Event) bool) {
+	t.Helper()
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case ev := <-sub.C:
+			if match(ev) {
+				return
+			}
+		case <-timeout:
+			t.Fatal("Event not published")
+		}
+	}
+}
+
+func TestRoomConcurrentJoinLeave(t *testing.T) {
+	ordo, agent := newTestCore(t)
+	room := joinTestRoom(t, ordo)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				var err error
+				if (i+j)%2 == 0 {
+					err = room.Join(ctx)
+				} else {
+					err = room.Leave(ctx, "bye")
+				}
+				if err != nil {
+					t.Error(err)
+				}
+				room.State()
+				room.Topic()
+			}
+		}(i)
+	}
+	// traffic while the room goroutine comes and goes
+	for i := 0; i < 50; i++ {
+		agent.Inject(testRoom, otherVK, chat(fmt.Sprint(i), "hello"))
+	}
+	wg.Wait()
+
+	if err := room.Join(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !room.IsAlive() {
+		t.Error("Room not alive after rejoining")
+	}
+	if n := agent.Subscriptions(); n != 1 {
+		t.Errorf("%d subscriptions open after rejoining, want 1", n)
+	}
+	if err := room.Leave(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+	if n := agent.Subscriptions(); n != 0 {
+		t.Errorf("%d subscriptions open after leaving, want 0", n)
+	}
+}
+
+func TestRoomDoubleLeave(t *testing.T) {
+	ordo, agent := newTestCore(t)
+	room := joinTestRoom(t, ordo)
+	ctx := context.Background()
+
+	if err := room.Leave(ctx, "first"); err != nil {
+		t.Fatal(err)
+	}
+	if err := room.Leave(ctx, "second"); err != nil {
+		t.Errorf("Second Leave failed: %s", err)
+	}
+	if room.IsAlive() {
+		t.Error("Room alive after leaving")
+	}
+	if n := countPublished(agent, testRoom, LeaveRoomPID); n != 1 {
+		t.Errorf("%d leave messages published, want 1", n)
+	}
+	if n := agent.Subscriptions(); n != 0 {
+		t.Errorf("%d subscriptions open, want 0", n)
+	}
+}
+
+func TestRoomDoubleStopTail(t *testing.T) {
+	ordo, agent := newTestCore(t)
+	room := joinTestRoom(t, ordo)
+
+	// stopping without having started is fine
+	room.StopTail()
+
+	messages := make(chan Message, 10)
+	room.StartTail(messages)
+	room.StopTail()
+	room.StopTail()
+
+	// held for the next tail rather than delivered
+	agent.Inject(testRoom, otherVK, chat("1", "queued"))
+	select {
+	case msg := <-messages:
+		t.Fatalf("Received %q after StopTail", msg.Message)
+	case <-time.After(50 * time.Millisecond):
+	}
+	room.StartTail(messages)
+	if msg := receive(t, messages); msg.Message != "queued" {
+		t.Errorf("Received %q, want queued", msg.Message)
+	}
+}
+
+func TestRoomDeliveryAfterResubscribe(t *testing.T) {
+	ordo, agent := newTestCore(t)
+	events := ordo.Subscribe(100, DropOldest)
+	defer events.Close()
+	room := joinTestRoom(t, ordo)
+	messages := make(chan Message, 10)
+	room.StartTail(messages)
+
+	agent.Inject(testRoom, otherVK, chat("1", "before"))
+	if msg := receive(t, messages); msg.Message != "before" {
+		t.Fatalf("Received %q, want before", msg.Message)
+	}
+
+	first := agent.Conn()
+	first.Close()
+	waitForEvent(t, events, func(ev Event) bool {
+		changed, ok := ev.(ConnectionChanged)
+		return ok && changed.Connected
+	})
+	if agent.Conn() == first {
+		t.Fatal("Did not reconnect")
+	}
+	if n := agent.Subscriptions(); n != 1 {
+		t.Errorf("%d subscriptions open after reconnecting, want 1", n)
+	}
+
+	// a copy of a message seen before the reconnect is dropped
+	agent.Inject(testRoom, otherVK, chat("1", "before"))
+	agent.Inject(testRoom, otherVK, chat("2", "after"))
+	if msg := receive(t, messages); msg.Message != "after" {
+		t.Errorf("Received %q, want after", msg.Message)
+	}
+}
+
+func TestRoomDoneClosesAfterCancel(t *testing.T) {
+	ordo, _ := newTestCore(t)
+	room := joinTestRoom(t, ordo)
+
+	room.lock.Lock()
+	cancel, done := room.cancel, room.done
+	room.lock.Unlock()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatal("Room goroutine still running after cancel")
+	}
+	// Leave copes with the goroutine having already exited
+	if err := room.Leave(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRoomNothingDeliveredAfterStopTail(t *testing.T) {
+	const otherRoom = "test.ns/room/other"
+	ordo, agent := newTestCore(t)
+	room := joinTestRoom(t, ordo)
+	other, err := ordo.JoinRoom(context.Background(), otherRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			agent.Inject(testRoom, otherVK, chat(fmt.Sprint(i), "old room"))
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+
+	// switching rooms the way the client does, over and over
+	for i := 0; i < 50; i++ {
+		screen := make(chan Message, 1000)
+		room.StartTail(screen)
+		time.Sleep(time.Millisecond)
+		room.StopTail()
+		other.StartTail(screen)
+		n := len(screen)
+		time.Sleep(2 * time.Millisecond)
+		if len(screen) != n {
+			t.Fatalf("%d messages delivered after StopTail returned", len(screen)-n)
+		}
+		other.StopTail()
+	}
+}
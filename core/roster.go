@@ -0,0 +1,97 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+// roster tracks who is in a room. It is written by the room goroutine and read
+// from anywhere, so every accessor returns a copy
+type roster struct {
+	sync.RWMutex
+	selfVK    string
+	selfAlias string
+	// map of known user VKs to aliases
+	aliases map[string]string
+	// map of known user VKs to when we last heard from them
+	lastSeen map[string]time.Time
+}
+
+func newRoster(selfVK, selfAlias string) *roster {
+	r := &roster{selfVK: selfVK, selfAlias: selfAlias}
+	r.reset()
+	return r
+}
+
+// forgets everyone but ourselves
+func (r *roster) reset() {
+	r.Lock()
+	defer r.Unlock()
+	r.aliases = map[string]string{r.selfVK: r.selfAlias}
+	r.lastSeen = map[string]time.Time{r.selfVK: time.Now()}
+}
+
+// records a join by vk under the given alias, returning the new member and the
+// alias they were known by before, if any
+func (r *roster) join(vk, alias string) (Member, string) {
+	r.Lock()
+	defer r.Unlock()
+	previous := r.aliases[vk]
+	r.aliases[vk] = alias
+	r.lastSeen[vk] = time.Now()
+	return r.member(vk), previous
+}
+
+// records vk leaving, returning the member as they were before they left
+func (r *roster) leave(vk string) Member {
+	r.Lock()
+	defer r.Unlock()
+	member := r.member(vk)
+	delete(r.aliases, vk)
+	delete(r.lastSeen, vk)
+	return member
+}
+
+// must be called with the lock held
+func (r *roster) member(vk string) Member {
+	member := Member{VK: vk, Alias: r.aliases[vk], LastSeen: r.lastSeen[vk]}
+	if vk == r.selfVK {
+		member.Role = SelfRole
+	}
+	return member
+}
+
+// records activity by vk under the given alias. Returns the alias they were known
+// by before, if any
+func (r *roster) seen(vk, alias string) string {
+	r.Lock()
+	defer r.Unlock()
+	previous := r.aliases[vk]
+	r.aliases[vk] = alias
+	r.lastSeen[vk] = time.Now()
+	return previous
+}
+
+// returns a copy of the map of VKs to aliases
+func (r *roster) snapshot() map[string]string {
+	r.RLock()
+	defer r.RUnlock()
+	aliases := make(map[string]string, len(r.aliases))
+	for vk, alias := range r.aliases {
+		aliases[vk] = alias
+	}
+	return aliases
+}
+
+// returns the known users sorted by presence, then alias
+func (r *roster) members() []Member {
+	r.RLock()
+	defer r.RUnlock()
+	now := time.Now()
+	members := make([]Member, 0, len(r.aliases))
+	for vk := range r.aliases {
+		members = append(members, r.member(vk))
+	}
+	sortMembers(members, now)
+	return members
+}
@@ -0,0 +1,85 @@
+package core
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// the count and the member list must always agree
+func checkCount(t *testing.T, r *roster, want int) {
+	t.Helper()
+	members := r.members()
+	if len(members) != want {
+		t.Errorf("%d members, want %d", len(members), want)
+	}
+	if n := len(r.snapshot()); n != want {
+		t.Errorf("%d aliases, want %d", n, want)
+	}
+}
+
+func TestRosterRepeatedJoin(t *testing.T) {
+	r := newRoster(testVK, "tester")
+	r.join(otherVK, "other")
+	member, previous := r.join(otherVK, "renamed")
+	if previous != "other" {
+		t.Errorf("Previous alias %q, want other", previous)
+	}
+	if member.Alias != "renamed" {
+		t.Errorf("Alias %q, want renamed", member.Alias)
+	}
+	checkCount(t, r, 2)
+}
+
+func TestRosterLeaveUnknown(t *testing.T) {
+	r := newRoster(testVK, "tester")
+	r.leave(otherVK)
+	r.leave(otherVK)
+	checkCount(t, r, 1)
+
+	r.join(otherVK, "other")
+	r.leave(otherVK)
+	r.leave(otherVK)
+	checkCount(t, r, 1)
+}
+
+func TestRosterReset(t *testing.T) {
+	r := newRoster(testVK, "tester")
+	r.join(otherVK, "other")
+	r.reset()
+	checkCount(t, r, 1)
+	if members := r.members(); members[0].Role != SelfRole {
+		t.Errorf("Reset kept %+v, want ourselves", members[0])
+	}
+}
+
+func TestRosterConcurrent(t *testing.T) {
+	r := newRoster(testVK, "tester")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			vk := fmt.Sprintf("vk-%d", i%4)
+			for j := 0; j < 100; j++ {
+				switch j % 4 {
+				case 0:
+					r.join(vk, "joined")
+				case 1:
+					r.seen(vk, "seen")
+				case 2:
+					r.leave(vk)
+				case 3:
+					r.members()
+					r.snapshot()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	checkCount(t, r, len(r.snapshot()))
+	for i := 0; i < 4; i++ {
+		r.leave(fmt.Sprintf("vk-%d", i))
+	}
+	checkCount(t, r, 1)
+}
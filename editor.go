@@ -0,0 +1,331 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jroimartin/gocui"
+	"strings"
+	"unicode"
+)
+
+// InputEditor is the line editor behind the "input" view. It keeps its own buffer
+// so it can offer emacs-style editing, history and reverse search, and redraws
+// the view after every key.
+//
+// Terminals cannot distinguish Shift-Enter from Enter, so a newline is inserted
+// with Alt-Enter or Ctrl-J instead.
+//
+// Typing '/' into an empty buffer starts a search of the chatroom view; type '//'
+// to send a message starting with '/'.
+type InputEditor struct {
+	buf    []rune
+	cursor int
+
+	history *History
+	// index into history while browsing with up/down. history.Len() when not browsing
+	histIdx int
+	// what was being typed before browsing started
+	draft []rune
+
+	// reverse incremental search state
+	searching bool
+	query     []rune
+	match     int
+
+	// chatroom search state. Enter calls searchChat with the query
+	chatSearching bool
+	searchChat    func(query string)
+
+	// tab completion state: candidates cycled through by repeated Tabs, which one is
+	// showing, and where the completed word starts
+	complete    CompleteFunc
+	completions []string
+	compIdx     int
+	compStart   int
+
+	// called with the contents of the buffer when the user presses Enter
+	submit func(input string)
+}
+
+func NewInputEditor(history *History, complete CompleteFunc, searchChat, submit func(input string)) *InputEditor {
+	return &InputEditor{
+		history:    history,
+		histIdx:    history.Len(),
+		complete:   complete,
+		searchChat: searchChat,
+		submit:     submit,
+	}
+}
+
+func (e *InputEditor) Edit(v *gocui.View, key gocui.Key, ch rune, mod gocui.Modifier) {
+	if e.searching {
+		e.editSearch(key, ch, mod)
+		e.render(v)
+		return
+	}
+	if e.chatSearching {
+		e.editChatSearch(key, ch, mod)
+		e.render(v)
+		return
+	}
+	if len(e.buf) == 0 && ch == '/' && mod == gocui.ModNone {
+		e.chatSearching = true
+		e.query = nil
+		e.render(v)
+		return
+	}
+	if key != gocui.KeyTab {
+		e.completions = nil
+	}
+	switch {
+	case key == gocui.KeyTab:
+		e.completeWord()
+	case key == gocui.KeyEnter && mod == gocui.ModAlt, key == gocui.KeyCtrlJ:
+		e.insert('\n')
+	case key == gocui.KeyEnter:
+		input := string(e.buf)
+		e.history.Add(input)
+		e.reset()
+		e.render(v)
+		e.submit(input)
+		return
+	case key == gocui.KeyCtrlA:
+		e.cursor = 0
+	case key == gocui.KeyCtrlE:
+		e.cursor = len(e.buf)
+	case key == gocui.KeyCtrlB, key == gocui.KeyArrowLeft:
+		if e.cursor > 0 {
+			e.cursor--
+		}
+	case key == gocui.KeyCtrlF, key == gocui.KeyArrowRight:
+		if e.cursor < len(e.buf) {
+			e.cursor++
+		}
+	case key == gocui.KeyBackspace, key == gocui.KeyBackspace2:
+		if e.cursor > 0 {
+			e.delete(e.cursor-1, e.cursor)
+		}
+	case key == gocui.KeyCtrlD, key == gocui.KeyDelete:
+		if e.cursor < len(e.buf) {
+			e.delete(e.cursor, e.cursor+1)
+		}
+	case key == gocui.KeyCtrlW:
+		e.delete(e.wordStart(), e.cursor)
+	case key == gocui.KeyCtrlU:
+		e.delete(0, e.cursor)
+	case key == gocui.KeyCtrlK:
+		e.delete(e.cursor, len(e.buf))
+	case key == gocui.KeyCtrlP, key == gocui.KeyArrowUp:
+		e.browse(-1)
+	case key == gocui.KeyCtrlN, key == gocui.KeyArrowDown:
+		e.browse(1)
+	case key == gocui.KeyCtrlR:
+		e.searching = true
+		e.query = nil
+		e.match = -1
+	case key == gocui.KeySpace:
+		e.insert(' ')
+	case ch != 0 && mod == gocui.ModNone:
+		e.insert(ch)
+	}
+	e.render(v)
+}
+
+// handles keys while in reverse-i-search. Enter accepts the match into the buffer,
+// Ctrl-R finds the next older match and Ctrl-G/Esc cancels
+func (e *InputEditor) editSearch(key gocui.Key, ch rune, mod gocui.Modifier) {
+	switch {
+	case key == gocui.KeyCtrlR:
+		if e.match > 0 {
+			if idx := e.history.SearchBack(string(e.query), e.match); idx >= 0 {
+				e.match = idx
+			}
+		}
+	case key == gocui.KeyCtrlG, key == gocui.KeyEsc:
+		e.searching = false
+	case key == gocui.KeyEnter:
+		e.searching = false
+		if e.match >= 0 {
+			e.buf = []rune(e.history.At(e.match))
+			e.cursor = len(e.buf)
+		}
+	case key == gocui.KeyBackspace, key == gocui.KeyBackspace2:
+		if len(e.query) > 0 {
+			e.query = e.query[:len(e.query)-1]
+			e.match = e.history.SearchBack(string(e.query), e.history.Len())
+		}
+	case key == gocui.KeySpace:
+		e.query = append(e.query, ' ')
+		e.match = e.history.SearchBack(string(e.query), e.history.Len())
+	case ch != 0 && mod == gocui.ModNone:
+		e.query = append(e.query, ch)
+		e.match = e.history.SearchBack(string(e.query), e.history.Len())
+	}
+}
+
+// handles keys while typing a chatroom search. A second '/' leaves search and
+// inserts a literal '/'
+func (e *InputEditor) editChatSearch(key gocui.Key, ch rune, mod gocui.Modifier) {
+	switch {
+	case key == gocui.KeyEnter:
+		e.chatSearching = false
+		e.searchChat(string(e.query))
+	case key == gocui.KeyCtrlG, key == gocui.KeyEsc:
+		e.chatSearching = false
+		e.searchChat("")
+	case key == gocui.KeyBackspace, key == gocui.KeyBackspace2:
+		if len(e.query) == 0 {
+			e.chatSearching = false
+		} else {
+			e.query = e.query[:len(e.query)-1]
+		}
+	case ch == '/' && len(e.query) == 0:
+		e.chatSearching = false
+		e.insert('/')
+	case key == gocui.KeySpace:
+		e.query = append(e.query, ' ')
+	case ch != 0 && mod == gocui.ModNone:
+		e.query = append(e.query, ch)
+	}
+}
+
+func (e *InputEditor) insert(ch rune) {
+	e.buf = append(e.buf, 0)
+	copy(e.buf[e.cursor+1:], e.buf[e.cursor:])
+	e.buf[e.cursor] = ch
+	e.cursor++
+}
+
+// removes buf[from:to] and leaves the cursor at from
+func (e *InputEditor) delete(from, to int) {
+	e.buf = append(e.buf[:from], e.buf[to:]...)
+	e.cursor = from
+}
+
+// index of the start of the word before the cursor, skipping trailing spaces
+func (e *InputEditor) wordStart() int {
+	i := e.cursor
+	for i > 0 && unicode.IsSpace(e.buf[i-1]) {
+		i--
+	}
+	for i > 0 && !unicode.IsSpace(e.buf[i-1]) {
+		i--
+	}
+	return i
+}
+
+// completes the word under the cursor. A unique match is inserted followed by a space;
+// otherwise the common prefix is inserted and further Tabs cycle through the matches
+func (e *InputEditor) completeWord() {
+	if e.complete == nil {
+		return
+	}
+	if len(e.completions) > 1 {
+		e.compIdx = (e.compIdx + 1) % len(e.completions)
+		e.replaceWord(e.compStart, e.completions[e.compIdx])
+		return
+	}
+	start := e.cursor
+	for start > 0 && !unicode.IsSpace(e.buf[start-1]) {
+		start--
+	}
+	word := string(e.buf[start:e.cursor])
+	first := len(strings.TrimSpace(string(e.buf[:start]))) == 0
+	matches := e.complete(word, first)
+	switch len(matches) {
+	case 0:
+		return
+	case 1:
+		e.replaceWord(start, matches[0]+" ")
+	default:
+		e.completions = matches
+		e.compStart = start
+		if prefix := commonPrefix(matches); len(prefix) > len(word) {
+			e.compIdx = -1
+			e.replaceWord(start, prefix)
+		} else {
+			e.compIdx = 0
+			e.replaceWord(start, matches[0])
+		}
+	}
+}
+
+// replaces buf[start:cursor] with text and moves the cursor to the end of it
+func (e *InputEditor) replaceWord(start int, text string) {
+	tail := e.buf[e.cursor:]
+	buf := make([]rune, 0, len(e.buf)+len(text))
+	buf = append(buf, e.buf[:start]...)
+	buf = append(buf, []rune(text)...)
+	e.cursor = len(buf)
+	e.buf = append(buf, tail...)
+}
+
+// moves through history by delta entries, saving the draft when leaving it
+func (e *InputEditor) browse(delta int) {
+	next := e.histIdx + delta
+	if next < 0 || next > e.history.Len() {
+		return
+	}
+	if e.histIdx == e.history.Len() {
+		e.draft = e.buf
+	}
+	e.histIdx = next
+	if next == e.history.Len() {
+		e.buf = e.draft
+	} else {
+		e.buf = []rune(e.history.At(next))
+	}
+	e.cursor = len(e.buf)
+}
+
+func (e *InputEditor) reset() {
+	e.buf = nil
+	e.cursor = 0
+	e.draft = nil
+	e.histIdx = e.history.Len()
+}
+
+// redraws the buffer into the view and places the cursor, accounting for wrapping
+func (e *InputEditor) render(v *gocui.View) {
+	v.Clear()
+	if e.searching {
+		var found string
+		if e.match >= 0 {
+			found = e.history.At(e.match)
+		}
+		prompt := fmt.Sprintf("(reverse-i-search)`%s': %s", string(e.query), found)
+		fmt.Fprint(v, prompt)
+		runes := []rune(prompt)
+		x, y := cursorPosition(runes, len(runes), v)
+		v.SetCursor(x, y)
+		return
+	}
+	if e.chatSearching {
+		prompt := []rune("/" + string(e.query))
+		fmt.Fprint(v, string(prompt))
+		x, y := cursorPosition(prompt, len(prompt), v)
+		v.SetCursor(x, y)
+		return
+	}
+	fmt.Fprint(v, string(e.buf))
+	x, y := cursorPosition(e.buf, e.cursor, v)
+	v.SetCursor(x, y)
+}
+
+// returns the on-screen position of the idx'th rune of buf inside a wrapping view
+func cursorPosition(buf []rune, idx int, v *gocui.View) (x, y int) {
+	width, _ := v.Size()
+	if idx > len(buf) {
+		idx = len(buf)
+	}
+	for _, ch := range buf[:idx] {
+		if ch == '\n' {
+			x, y = 0, y+1
+			continue
+		}
+		x++
+		if width > 0 && x >= width {
+			x, y = 0, y+1
+		}
+	}
+	return
+}
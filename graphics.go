@@ -2,23 +2,80 @@ package main
 
 import (
 	"fmt"
+	"github.com/gtfierro/ordo/core"
 	"github.com/jroimartin/gocui"
 	"github.com/pkg/errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SidebarWidth = 30
+	// below this terminal width the sidebar is hidden
+	MinWidthForSidebar = 80
+	InputHeight        = 10
+	// below this terminal height the input area shrinks to CompactInputHeight
+	MinHeightForInput  = 24
+	CompactInputHeight = 3
+	MembersWidth       = 26
+	// below this terminal width the member list is hidden
+	MinWidthForMembers = 100
+	// height of each room's entry in the sidebar
+	roomViewHeight = 5
 )
 
 type UserInterface struct {
-	g          *gocui.Gui
-	client     *OrdoClient
-	header     string
-	roomOffset int
+	g        *gocui.Gui
+	client   *OrdoClient
+	header   string
+	history  *History
+	chat     *ChatView
+	renderer *Renderer
+	theme    *Theme
+	keymap   *Keymap
+
+	// receives the result of the main loop once it exits, and why the user quit
+	done       chan error
+	quitReason string
+
+	// whether the sidebar and the member list are shown
+	showSidebar bool
+	showMembers bool
+	// whether the member list has focus, and which member is selected in it
+	membersFocused bool
+	memberSelected int
+
+	// what the chatroom header shows: the current room and whether the agent
+	// connection is up
+	statusLock sync.Mutex
+	roomLabel  string
+	connected  bool
+
+	// latest state of each joined room by URI, in the order they are shown in the
+	// sidebar, and the views of rooms that have been left and need to be removed
+	roomsLock  sync.Mutex
+	roomOrder  []string
+	rooms      map[string]core.RoomState
+	staleViews []string
 }
 
-func StartUserInterface(client *OrdoClient) *UserInterface {
+func StartUserInterface(client *OrdoClient, renderer *Renderer, theme *Theme, keymap *Keymap) *UserInterface {
 	ui := &UserInterface{
-		g:          gocui.NewGui(),
-		client:     client,
-		header:     fmt.Sprintf("[%s]> ", client.Alias),
-		roomOffset: -1,
+		g:           gocui.NewGui(),
+		client:      client,
+		header:      fmt.Sprintf("[%s]> ", client.Alias),
+		history:     NewHistory(HistorySize),
+		chat:        NewChatView(ChatScrollback),
+		renderer:    renderer,
+		theme:       theme,
+		keymap:      keymap,
+		showSidebar: true,
+		showMembers: true,
+		rooms:       make(map[string]core.RoomState),
+		done:        make(chan error, 1),
+		roomLabel:   "<No Chatroom Joined>",
+		connected:   true,
 	}
 
 	if err := ui.g.Init(); err != nil {
@@ -30,90 +87,149 @@ func StartUserInterface(client *OrdoClient) *UserInterface {
 	}
 
 	go func() {
-		defer ui.g.Close()
-		if err := ui.g.MainLoop(); err != nil && err != gocui.ErrQuit {
-			log.Fatal(errors.Wrap(err, "Main loop of gocui broke"))
+		err := ui.g.MainLoop()
+		if err == gocui.ErrQuit {
+			err = nil
 		}
+		ui.done <- errors.Wrap(err, "Main loop of gocui broke")
 	}()
 
 	go func() {
-		for state := range ui.client.roomStates {
-			name := state.Name
-			height := state.Height()
-			users := state.CurrentUsers
-			numUnread := state.NumUnreadMessages
-			numUsers := state.NumCurrentUsers
-			ui.g.Execute(func(g *gocui.Gui) error {
-				v, err := g.View(name)
-				if err == gocui.ErrUnknownView {
-					v, err = g.SetView(name, -1, ui.roomOffset, 30, ui.roomOffset+height)
-					ui.roomOffset += height
-					if err != gocui.ErrUnknownView {
-						return err
-					}
-				} else if err != nil {
-					return err
+		for ev := range ui.client.Subscribe(100, core.DropOldest).C {
+			switch ev := ev.(type) {
+			case core.RoomStateChanged:
+				ui.updateRoom(ev.State)
+				// layout draws the room views
+				ui.g.Execute(func(g *gocui.Gui) error { return nil })
+				if ev.State.Room != nil && ev.State.Room.URI == ui.client.CurrentRoomURI() {
+					ui.redrawHeader()
 				}
-
-				v.Clear()
-				fmt.Fprintln(v, fmt.Sprintf("Room: [%s]", name))
-				fmt.Fprintln(v, fmt.Sprintf("  Unread(%d)", numUnread))
-				fmt.Fprintln(v, fmt.Sprintf("  Users(%d)", numUsers))
-				for _, alias := range users {
-					fmt.Fprintln(v, fmt.Sprintf("    %s", alias))
+			case core.OutboundChanged:
+				// the local echo, shown until the room echoes the message back
+				key := "msg:" + ev.Item.MessageID
+				switch ev.Item.State {
+				case core.Pending, core.Failed:
+					ui.chat.Put(key, ui.renderer.RenderOutbound(ev.Item, ui.client.Alias))
+				case core.Sent:
+					ui.chat.Replace(key, ui.renderer.RenderOutbound(ev.Item, ui.client.Alias))
+				case core.Discarded:
+					ui.chat.Remove(key)
 				}
-				return nil
-			})
+				ui.redrawChat()
+			case core.TopicChanged:
+				ui.redrawHeader()
+			case core.ConnectionChanged:
+				ui.statusLock.Lock()
+				ui.connected = ev.Connected
+				ui.statusLock.Unlock()
+				ui.redrawHeader()
+			}
 		}
 	}()
 
 	return ui
 }
 
+// records the latest state of a room, forgetting rooms that have been left
+func (ui *UserInterface) updateRoom(state core.RoomState) {
+	ui.roomsLock.Lock()
+	defer ui.roomsLock.Unlock()
+	_, known := ui.rooms[state.URI]
+	if !state.Alive {
+		if known {
+			delete(ui.rooms, state.URI)
+			for i, uri := range ui.roomOrder {
+				if uri == state.URI {
+					ui.roomOrder = append(ui.roomOrder[:i], ui.roomOrder[i+1:]...)
+					break
+				}
+			}
+			ui.staleViews = append(ui.staleViews, roomViewName(state.URI))
+		}
+		return
+	}
+	if !known {
+		ui.roomOrder = append(ui.roomOrder, state.URI)
+	}
+	ui.rooms[state.URI] = state
+}
+
+// rooms in different namespaces can share a name, so views are named by URI
+func roomViewName(uri string) string {
+	return "room:" + uri
+}
+
+// positions every view from the current terminal size. gocui calls this on every
+// redraw, so views follow terminal resizes
 func (ui *UserInterface) layout(g *gocui.Gui) error {
 	maxX, maxY := g.Size()
-	// sidebar
-	if v, err := g.SetView("sidebar", -1, -1, 30, maxY); err != nil {
-		if err != gocui.ErrUnknownView {
-			return err
-		}
-		v.Wrap = true
-		fmt.Fprintln(v, "ROOMS")
+	sidebar := -1
+	if ui.showSidebar && maxX >= MinWidthForSidebar {
+		sidebar = SidebarWidth
+	}
+	inputHeight := InputHeight
+	if maxY < MinHeightForInput {
+		inputHeight = CompactInputHeight
+	}
+	right := maxX
+	if ui.showMembers && maxX >= MinWidthForMembers {
+		right = maxX - MembersWidth
+	}
+
+	if err := ui.layoutSidebar(g, sidebar, maxY); err != nil {
+		return err
+	}
+	if err := ui.layoutMembers(g, right, maxX, maxY); err != nil {
+		return err
 	}
 	// chatroom header
-	if v, err := g.SetView("chatroomname", 30, -1, maxX, 2); err != nil {
+	if v, err := g.SetView("chatroomname", sidebar, -1, right, 2); err != nil {
 		if err != gocui.ErrUnknownView {
 			return err
 		}
 		v.Wrap = true
-		v.FgColor = gocui.AttrBold
-		fmt.Fprintln(v, "<No Chatroom Joined>")
+		v.FgColor = ui.theme.ViewColor(ui.theme.Header)
+		ui.drawHeader(v)
 	}
 	// chatroom
-	if v, err := g.SetView("chatroom", 30, 2, maxX, maxY-10); err != nil {
+	if v, err := g.SetView("chatroom", sidebar, 2, right, maxY-inputHeight); err != nil {
 		if err != gocui.ErrUnknownView {
 			return err
 		}
 		v.Wrap = true
-		v.Autoscroll = true
 		go func() {
-			for msg := range ui.client.Screen {
-				from := msg.From
-				message := msg.Message
-				g.Execute(func(g *gocui.Gui) error {
-					v, err := g.View("chatroom")
-					if err != nil {
-						log.Fatal(errors.Wrap(err, "Could not update chatroom screen"))
+			for {
+				var lines []string
+				select {
+				case msg := <-ui.client.Screen:
+					if msg.Kind != core.ChatKind && msg.Room != nil && !ui.client.ShowsEvents(msg.Room.URI) {
+						continue
+					}
+					lines = ui.renderer.Render(msg)
+					if len(msg.ID) > 0 {
+						// the message replaces its local echo if it is one of ours
+						last := lines[len(lines)-1]
+						for _, line := range lines[:len(lines)-1] {
+							ui.chat.Append(line)
+						}
+						ui.chat.Resolve("msg:"+msg.ID, last)
+						lines = nil
 					}
-					fmt.Fprintln(v, fmt.Sprintf("[%s]> %s", from, message))
-					return nil
-				})
+				case notice := <-ui.client.Notices:
+					lines = ui.renderer.RenderNotice(notice)
+				}
+				for _, line := range lines {
+					ui.chat.Append(line)
+				}
+				ui.redrawChat()
 			}
 		}()
-
+	} else {
+		// the visible part of the scrollback depends on the view size
+		ui.chat.Render(v)
 	}
 	// input prompt
-	if v, err := g.SetView("prompt", 30, maxY-10, 30+len(ui.header), maxY); err != nil {
+	if v, err := g.SetView("prompt", sidebar, maxY-inputHeight, sidebar+len(ui.header), maxY); err != nil {
 		if err != gocui.ErrUnknownView {
 			return err
 		}
@@ -122,73 +238,392 @@ func (ui *UserInterface) layout(g *gocui.Gui) error {
 	}
 
 	// input box
-	if v, err := g.SetView("input", 30+len(ui.header), maxY-10, maxX, maxY); err != nil {
+	if v, err := g.SetView("input", sidebar+len(ui.header), maxY-inputHeight, right, maxY); err != nil {
 		if err != gocui.ErrUnknownView {
 			return err
 		}
 		g.Cursor = true
 		v.Wrap = true
 		v.Editable = true
+		v.Editor = NewInputEditor(ui.history, ui.client.Complete, ui.searchChat, ui.parse)
 		v.Frame = false
 		if err := g.SetCurrentView("input"); err != nil {
 			return err
 		}
-		//v.SetCursor(len(ui.header), 0)
 	}
 
 	return nil
 }
 
-func (ui *UserInterface) keybindings(g *gocui.Gui) error {
-	if err := ui.g.SetKeybinding("", gocui.KeyCtrlC, gocui.ModNone, ui.quit); err != nil {
-		log.Fatal(err)
+// draws the sidebar and a view per joined room inside it, or removes them all if
+// the sidebar is hidden (width < 0)
+func (ui *UserInterface) layoutSidebar(g *gocui.Gui, width, maxY int) error {
+	ui.roomsLock.Lock()
+	defer ui.roomsLock.Unlock()
+	for _, name := range ui.staleViews {
+		if err := g.DeleteView(name); err != nil && err != gocui.ErrUnknownView {
+			return err
+		}
 	}
-	if err := ui.g.SetKeybinding("input", gocui.KeyEnter, gocui.ModNone, ui.parse); err != nil {
-		log.Fatal(err)
+	ui.staleViews = nil
+
+	if width < 0 {
+		for _, name := range append(ui.roomOrder, "sidebar") {
+			if name != "sidebar" {
+				name = roomViewName(name)
+			}
+			if err := g.DeleteView(name); err != nil && err != gocui.ErrUnknownView {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if v, err := g.SetView("sidebar", -1, -1, width, maxY); err != nil {
+		if err != gocui.ErrUnknownView {
+			return err
+		}
+		v.Wrap = true
+		v.FgColor = ui.theme.ViewColor(ui.theme.Sidebar)
+		fmt.Fprintln(v, "ROOMS")
+	}
+
+	offset := 0
+	for _, uri := range ui.roomOrder {
+		state := ui.rooms[uri]
+		v, err := g.SetView(roomViewName(uri), -1, offset, width, offset+roomViewHeight)
+		if err != nil {
+			if err != gocui.ErrUnknownView {
+				return err
+			}
+			v.FgColor = ui.theme.ViewColor(ui.theme.Sidebar)
+		}
+		offset += roomViewHeight
+
+		v.Clear()
+		fmt.Fprintln(v, fmt.Sprintf("Room: [%s]", state.Name))
+		fmt.Fprintln(v, fmt.Sprintf("  Unread(%d) Mentions(%d)", state.NumUnreadMessages, state.NumUnreadMentions))
+		fmt.Fprintln(v, fmt.Sprintf("  Users(%d)", state.NumCurrentUsers))
 	}
 	return nil
 }
 
-func (ui *UserInterface) quit(g *gocui.Gui, v *gocui.View) error {
-	return gocui.ErrQuit
+// draws the members of the current room between x0 and maxX, or removes the
+// pane if there is no room for it (x0 == maxX). The selected member's presence
+// and VK fingerprint are shown below the list
+func (ui *UserInterface) layoutMembers(g *gocui.Gui, x0, maxX, maxY int) error {
+	if x0 >= maxX {
+		if ui.membersFocused {
+			ui.membersFocused = false
+			if err := g.SetCurrentView("input"); err != nil {
+				return err
+			}
+		}
+		if err := g.DeleteView("members"); err != nil && err != gocui.ErrUnknownView {
+			return err
+		}
+		return nil
+	}
+	v, err := g.SetView("members", x0, -1, maxX, maxY)
+	if err != nil && err != gocui.ErrUnknownView {
+		return err
+	}
+	v.Highlight = ui.membersFocused
+
+	var members []core.Member
+	current := ui.client.CurrentRoomURI()
+	ui.roomsLock.Lock()
+	members = ui.rooms[current].Members
+	ui.roomsLock.Unlock()
+
+	if ui.memberSelected >= len(members) {
+		ui.memberSelected = len(members) - 1
+	}
+	if ui.memberSelected < 0 {
+		ui.memberSelected = 0
+	}
+
+	v.Clear()
+	now := time.Now()
+	fmt.Fprintln(v, fmt.Sprintf("Members (%d)", len(members)))
+	for _, member := range members {
+		line := fmt.Sprintf("%s %s", presenceMarker(member.Presence(now)), member.Alias)
+		if member.Role != core.MemberRole {
+			line += fmt.Sprintf(" (%s)", member.Role)
+		}
+		fmt.Fprintln(v, line)
+	}
+	if ui.membersFocused && len(members) > 0 {
+		selected := members[ui.memberSelected]
+		fmt.Fprintln(v, "")
+		fmt.Fprintln(v, selected.Alias)
+		fmt.Fprintln(v, fmt.Sprintf("  %s, %s", selected.Presence(now), selected.Role))
+		fmt.Fprintln(v, fmt.Sprintf("  %s", selected.Fingerprint()))
+		v.SetCursor(0, ui.memberSelected+1)
+	}
+	return nil
 }
 
-func (ui *UserInterface) parse(g *gocui.Gui, v *gocui.View) error {
-	input := v.ViewBuffer()
-	if len(input) == 0 {
-		v.Clear()
-		v.SetCursor(0, 0)
+func presenceMarker(p core.Presence) string {
+	switch p {
+	case core.Online:
+		return "+"
+	case core.Idle:
+		return "~"
+	default:
+		return "-"
+	}
+}
+
+// moves focus between the input box and the member list
+func (ui *UserInterface) focusMembers(g *gocui.Gui, v *gocui.View) error {
+	if _, err := g.View("members"); err != nil {
 		return nil
 	}
-	cmd := Parse(input[:len(input)-1])
+	ui.membersFocused = !ui.membersFocused
+	if ui.membersFocused {
+		g.Cursor = false
+		return g.SetCurrentView("members")
+	}
+	g.Cursor = true
+	return g.SetCurrentView("input")
+}
 
-	// clear input
-	v.Clear()
-	v.SetCursor(0, 0)
+func (ui *UserInterface) selectMember(delta int) gocui.KeybindingHandler {
+	return func(g *gocui.Gui, v *gocui.View) error {
+		ui.memberSelected += delta
+		return nil
+	}
+}
 
-	go ui.client.runCommand(cmd)
+func (ui *UserInterface) toggleSidebar(g *gocui.Gui, v *gocui.View) error {
+	ui.showSidebar = !ui.showSidebar
+	return nil
+}
 
-	switch cmd.Type {
-	case JoinCommand:
-		g.Execute(func(g *gocui.Gui) error {
-			v, err := g.View("chatroomname")
+func (ui *UserInterface) toggleMembers(g *gocui.Gui, v *gocui.View) error {
+	ui.showMembers = !ui.showMembers
+	return nil
+}
+
+func (ui *UserInterface) keybindings(g *gocui.Gui) error {
+	scroll := ui.scroll
+	handlers := map[string]gocui.KeybindingHandler{
+		QuitAction:          ui.quit,
+		NextRoomAction:      ui.switchRoom(1),
+		PrevRoomAction:      ui.switchRoom(-1),
+		ScrollUpAction:      scroll(func(height int) { ui.chat.ScrollBy(height - 1) }),
+		ScrollDownAction:    scroll(func(height int) { ui.chat.ScrollBy(-(height - 1)) }),
+		ScrollTopAction:     scroll(func(int) { ui.chat.ScrollTop() }),
+		ScrollBottomAction:  scroll(func(int) { ui.chat.ScrollBottom() }),
+		NextMatchAction:     scroll(func(int) { ui.chat.NextMatch(nextMatchDir) }),
+		PrevMatchAction:     scroll(func(int) { ui.chat.NextMatch(prevMatchDir) }),
+		ToggleMembersAction: ui.toggleMembers,
+		ToggleSidebarAction: ui.toggleSidebar,
+		FocusMembersAction:  ui.focusMembers,
+		MarkReadAction:      ui.markRead,
+	}
+	for action, keys := range ui.keymap.Bindings {
+		handler, found := handlers[action]
+		if !found {
+			return errors.New(fmt.Sprintf("No handler for action %s", action))
+		}
+		for _, name := range keys {
+			key, mod, err := parseKey(name)
 			if err != nil {
-				log.Fatal(errors.Wrap(err, "Could not update input screen"))
+				return err
 			}
-			v.Clear()
-			fmt.Fprintln(v, "URI: ", cmd.Args[0])
-			return nil
-		})
-	case LeaveCommand:
-		g.Execute(func(g *gocui.Gui) error {
-			v, err := g.View("chatroomname")
-			if err != nil {
-				log.Fatal(errors.Wrap(err, "Could not update input screen"))
+			if err := g.SetKeybinding("", key, mod, handler); err != nil {
+				return err
 			}
-			v.Clear()
-			fmt.Fprintln(v, "URI: None")
-			return nil
-		})
+		}
+	}
+
+	if err := g.SetKeybinding("members", gocui.KeyEsc, gocui.ModNone, ui.focusMembers); err != nil {
+		return err
+	}
+	if err := g.SetKeybinding("members", gocui.KeyArrowUp, gocui.ModNone, ui.selectMember(-1)); err != nil {
+		return err
+	}
+	if err := g.SetKeybinding("members", gocui.KeyArrowDown, gocui.ModNone, ui.selectMember(1)); err != nil {
+		return err
+	}
+
+	if ui.keymap.Vi {
+		return ui.viKeybindings(g)
+	}
+	return nil
+}
+
+// binds the vi normal mode, which lives in the chatroom view
+func (ui *UserInterface) viKeybindings(g *gocui.Gui) error {
+	normal := []struct {
+		key     interface{}
+		handler gocui.KeybindingHandler
+	}{
+		{'j', ui.scroll(func(int) { ui.chat.ScrollBy(-1) })},
+		{'k', ui.scroll(func(int) { ui.chat.ScrollBy(1) })},
+		{gocui.KeyCtrlD, ui.scroll(func(height int) { ui.chat.ScrollBy(-height / 2) })},
+		{gocui.KeyCtrlU, ui.scroll(func(height int) { ui.chat.ScrollBy(height / 2) })},
+		{'g', ui.scroll(func(int) { ui.chat.ScrollTop() })},
+		{'G', ui.scroll(func(int) { ui.chat.ScrollBottom() })},
+		{'n', ui.scroll(func(int) { ui.chat.NextMatch(nextMatchDir) })},
+		{'N', ui.scroll(func(int) { ui.chat.NextMatch(prevMatchDir) })},
+		{'i', ui.insertMode},
+	}
+	for _, binding := range normal {
+		if err := g.SetKeybinding("chatroom", binding.key, gocui.ModNone, binding.handler); err != nil {
+			return err
+		}
 	}
+	return g.SetKeybinding("input", gocui.KeyEsc, gocui.ModNone, ui.normalMode)
+}
+
+func (ui *UserInterface) normalMode(g *gocui.Gui, v *gocui.View) error {
+	g.Cursor = false
+	return g.SetCurrentView("chatroom")
+}
+
+func (ui *UserInterface) insertMode(g *gocui.Gui, v *gocui.View) error {
+	g.Cursor = true
+	return g.SetCurrentView("input")
+}
+
+// returns a handler that joins the next (or previous, if delta is negative) joined room
+func (ui *UserInterface) switchRoom(delta int) gocui.KeybindingHandler {
+	return func(g *gocui.Gui, v *gocui.View) error {
+		if uri := ui.client.AdjacentRoomURI(delta); len(uri) > 0 {
+			ui.parse("\\join " + uri)
+		}
+		return nil
+	}
+}
+
+func (ui *UserInterface) markRead(g *gocui.Gui, v *gocui.View) error {
+	go ui.client.MarkAllRead()
 	return nil
 }
+
+func (ui *UserInterface) redrawChat() {
+	ui.g.Execute(func(g *gocui.Gui) error {
+		v, err := g.View("chatroom")
+		if err != nil {
+			log.Fatal(errors.Wrap(err, "Could not update chatroom screen"))
+		}
+		ui.chat.Render(v)
+		return nil
+	})
+}
+
+// returns a keybinding handler that applies fxn to the chat view and redraws it
+func (ui *UserInterface) scroll(fxn func(height int)) gocui.KeybindingHandler {
+	return func(g *gocui.Gui, v *gocui.View) error {
+		chatroom, err := g.View("chatroom")
+		if err != nil {
+			return err
+		}
+		_, height := chatroom.Size()
+		fxn(height)
+		ui.chat.Render(chatroom)
+		return nil
+	}
+}
+
+func (ui *UserInterface) searchChat(query string) {
+	if n := ui.chat.Search(query); len(query) > 0 && n == 0 {
+		ui.client.display(printInfo("No matches for ", query))
+	}
+	ui.redrawChat()
+}
+
+func (ui *UserInterface) quit(g *gocui.Gui, v *gocui.View) error {
+	return gocui.ErrQuit
+}
+
+// stops the main loop. The terminal stays in use until Close
+func (ui *UserInterface) Quit(reason string) {
+	ui.g.Execute(func(g *gocui.Gui) error {
+		ui.quitReason = reason
+		return gocui.ErrQuit
+	})
+}
+
+// blocks until the user quits, returning the reason they gave and any error
+// that stopped the main loop
+func (ui *UserInterface) Wait() (string, error) {
+	err := <-ui.done
+	return ui.quitReason, err
+}
+
+// restores the terminal
+func (ui *UserInterface) Close() {
+	ui.g.Close()
+}
+
+// handles a line submitted from the input editor
+func (ui *UserInterface) parse(input string) {
+	if len(input) == 0 {
+		return
+	}
+	cmd := Parse(input)
+	if cmd.Type == QuitCommand {
+		ui.Quit(strings.TrimSpace(strings.Join(cmd.Args, "")))
+		return
+	}
+
+	switch cmd.Type {
+	case JoinCommand, LeaveCommand:
+		go ui.changeRoom(cmd)
+	default:
+		go ui.client.runCommand(cmd)
+	}
+}
+
+// runs a join or leave, then labels the header with whatever room we end up in,
+// so a failed or bare \join leaves it alone
+func (ui *UserInterface) changeRoom(cmd Command) {
+	ui.client.runCommand(cmd)
+	ui.updateRoomLabel()
+}
+
+// shows the URI of the current room in the chatroom header
+func (ui *UserInterface) updateRoomLabel() {
+	label := "URI:  None"
+	if uri := ui.client.CurrentRoomURI(); len(uri) > 0 {
+		label = "URI:  " + uri
+	}
+	ui.statusLock.Lock()
+	ui.roomLabel = label
+	ui.statusLock.Unlock()
+	ui.redrawHeader()
+}
+
+// shows the current room and its topic in the chatroom header, and a warning while the agent
+// connection is down
+func (ui *UserInterface) drawHeader(v *gocui.View) {
+	ui.statusLock.Lock()
+	defer ui.statusLock.Unlock()
+	v.Clear()
+	fmt.Fprint(v, ui.roomLabel)
+	if topic := ui.client.CurrentRoomTopic(); len(topic) > 0 {
+		fmt.Fprint(v, "  -- ", topic)
+	}
+	if !ui.connected {
+		fmt.Fprint(v, "  ", ui.theme.Color(ui.theme.Error).SprintFunc()("[agent disconnected, reconnecting]"))
+	}
+	fmt.Fprintln(v)
+}
+
+func (ui *UserInterface) redrawHeader() {
+	ui.g.Execute(func(g *gocui.Gui) error {
+		v, err := g.View("chatroomname")
+		if err == gocui.ErrUnknownView {
+			// layout draws it once the view exists
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "Could not update chatroom header")
+		}
+		ui.drawHeader(v)
+		return nil
+	})
+}
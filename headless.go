@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"github.com/gtfierro/ordo/core"
+	"github.com/pkg/errors"
+	bw "gopkg.in/immesys/bw2bind.v5"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// exit statuses of the commands that run without the terminal interface, from sysexits(3)
+const (
+	ExitUsage       = 64
+	ExitDataErr     = 65
+	ExitUnavailable = 69
+	ExitIOErr       = 74
+	ExitTempFail    = 75
+)
+
+// prints err and exits with the given status
+func exitWith(status int, err error) {
+	fmt.Fprintln(os.Stderr, "bw2chat:", err)
+	os.Exit(status)
+}
+
+// resolves the profile for a headless command, exiting on bad usage
+func headlessProfile(c *cli.Context) Profile {
+	profile, err := resolveProfile(c)
+	if err != nil {
+		exitWith(ExitUsage, errors.Wrap(err, "Invalid configuration"))
+	}
+	return profile
+}
+
+// expands the rooms named with --room, exiting if there are none
+func headlessRooms(profile Profile, rooms []string) []string {
+	var uris []string
+	for _, room := range rooms {
+		if room = strings.TrimSpace(room); len(room) > 0 {
+			uris = append(uris, expandRoomURI(profile.Namespace, room))
+		}
+	}
+	if len(uris) == 0 {
+		exitWith(ExitUsage, errors.New("--room is required"))
+	}
+	return uris
+}
+
+// connects for a headless command, exiting if the agent or entity cannot be used
+func headlessCore(profile Profile, opts ...core.Option) *core.OrdoCore {
+	// the agent connection would otherwise log to stdout, which is our output
+	bw.SilenceLog()
+	opts = append([]core.Option{core.WithEntityFile(profile.Entity), core.WithAlias(profile.Alias)}, opts...)
+	ordo, err := core.New(opts...)
+	if err != nil {
+		exitWith(ExitUnavailable, err)
+	}
+	return ordo
+}
+
+// the message given on the command line: the arguments joined by spaces, or all
+// of stdin if the only argument is "-". On error, also returns the status to exit with
+func messageText(args []string, stdin io.Reader) (string, int, error) {
+	if len(args) == 0 {
+		return "", ExitUsage, errors.New("No message given")
+	}
+	text := strings.Join(args, " ")
+	if len(args) == 1 && args[0] == "-" {
+		contents, err := ioutil.ReadAll(stdin)
+		if err != nil {
+			return "", ExitIOErr, errors.Wrap(err, "Could not read message from stdin")
+		}
+		text = strings.TrimRight(string(contents), "\r\n")
+	}
+	if len(strings.TrimSpace(text)) == 0 {
+		return "", ExitDataErr, errors.New("Message is empty")
+	}
+	return text, 0, nil
+}
+
+func sendMessage(c *cli.Context) {
+	profile := headlessProfile(c)
+	roomURI := headlessRooms(profile, []string{c.String("room")})[0]
+	text, status, err := messageText(c.Args(), os.Stdin)
+	if err != nil {
+		exitWith(status, err)
+	}
+	ordo := headlessCore(profile)
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.Duration("timeout"))
+	defer cancel()
+	if err := ordo.Post(ctx, roomURI, text); err != nil {
+		exitWith(ExitTempFail, err)
+	}
+}
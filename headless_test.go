@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// a stdin that cannot be read
+type brokenReader struct{}
+
+func (brokenReader) Read(p []byte) (int, error) {
+	return 0, errors.New("input/output error")
+}
+
+func TestMessageTextStatus(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		args   []string
+		stdin  io.Reader
+		text   string
+		status int
+	}{
+		{"arguments", []string{"deployed", "v1.2.3"}, nil, "deployed v1.2.3", 0},
+		{"stdin", []string{"-"}, strings.NewReader("line one\nline two\n"), "line one\nline two", 0},
+		{"no arguments", nil, nil, "", ExitUsage},
+		{"blank arguments", []string{" ", ""}, nil, "", ExitDataErr},
+		{"empty stdin", []string{"-"}, strings.NewReader("\n"), "", ExitDataErr},
+		{"unreadable stdin", []string{"-"}, brokenReader{}, "", ExitIOErr},
+	} {
+		text, status, err := messageText(test.args, test.stdin)
+		if status != test.status {
+			t.Errorf("%s: exit status %d, want %d", test.name, status, test.status)
+		}
+		if (err != nil) != (test.status != 0) {
+			t.Errorf("%s: error %v with exit status %d", test.name, err, status)
+		}
+		if text != test.text {
+			t.Errorf("%s: message %q, want %q", test.name, text, test.text)
+		}
+	}
+}
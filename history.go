@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+const HistorySize = 500 // remember the last 500 entered lines
+
+// lines entered into the input box during this session, oldest first
+type History struct {
+	sync.RWMutex
+	entries []string
+	max     int
+}
+
+func NewHistory(max int) *History {
+	return &History{max: max}
+}
+
+// records a line. Empty lines and immediate repeats are skipped
+func (h *History) Add(line string) {
+	h.Lock()
+	defer h.Unlock()
+	if len(strings.TrimSpace(line)) == 0 {
+		return
+	}
+	if len(h.entries) > 0 && h.entries[len(h.entries)-1] == line {
+		return
+	}
+	if len(h.entries) >= h.max {
+		h.entries = h.entries[1:]
+	}
+	h.entries = append(h.entries, line)
+}
+
+func (h *History) Len() int {
+	h.RLock()
+	defer h.RUnlock()
+	return len(h.entries)
+}
+
+func (h *History) At(idx int) string {
+	h.RLock()
+	defer h.RUnlock()
+	if idx < 0 || idx >= len(h.entries) {
+		return ""
+	}
+	return h.entries[idx]
+}
+
+// searches backwards from (but not including) index 'before' for an entry containing query.
+// Returns -1 if nothing matches
+func (h *History) SearchBack(query string, before int) int {
+	h.RLock()
+	defer h.RUnlock()
+	if before > len(h.entries) {
+		before = len(h.entries)
+	}
+	for i := before - 1; i >= 0; i-- {
+		if strings.Contains(h.entries[i], query) {
+			return i
+		}
+	}
+	return -1
+}
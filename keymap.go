@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jroimartin/gocui"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"strings"
+	"unicode/utf8"
+)
+
+// actions that can be bound to keys
+const (
+	QuitAction          = "quit"
+	NextRoomAction      = "next-room"
+	PrevRoomAction      = "prev-room"
+	ScrollUpAction      = "scroll-up"
+	ScrollDownAction    = "scroll-down"
+	ScrollTopAction     = "scroll-top"
+	ScrollBottomAction  = "scroll-bottom"
+	NextMatchAction     = "next-match"
+	PrevMatchAction     = "prev-match"
+	ToggleMembersAction = "toggle-members"
+	ToggleSidebarAction = "toggle-sidebar"
+	FocusMembersAction  = "focus-members"
+	MarkReadAction      = "mark-read"
+)
+
+// Keymap maps actions to the keys that trigger them. Keys are written like
+// "ctrl-c", "alt-n", "f2", "pgup" or a single character. With Vi set, Esc in the
+// input box switches to a normal mode where j/k, ctrl-d/ctrl-u, g/G and n/N move
+// around the chatroom and i returns to the input box
+type Keymap struct {
+	Bindings map[string][]string `json:"bindings"`
+	Vi       bool                `json:"vi"`
+}
+
+func DefaultKeymap() *Keymap {
+	return &Keymap{
+		Bindings: map[string][]string{
+			QuitAction:          {"ctrl-c"},
+			NextRoomAction:      {"alt-right"},
+			PrevRoomAction:      {"alt-left"},
+			ScrollUpAction:      {"pgup"},
+			ScrollDownAction:    {"pgdn"},
+			ScrollTopAction:     {"home"},
+			ScrollBottomAction:  {"end"},
+			NextMatchAction:     {"alt-n"},
+			PrevMatchAction:     {"alt-p"},
+			ToggleMembersAction: {"f2"},
+			ToggleSidebarAction: {"f3"},
+			FocusMembersAction:  {"f4"},
+			MarkReadAction:      {"alt-r"},
+		},
+	}
+}
+
+// loads a keymap file, with actions it does not mention keeping their default
+// keys. An empty path returns the default keymap
+func LoadKeymap(path string) (*Keymap, error) {
+	keymap := DefaultKeymap()
+	if len(path) == 0 {
+		return keymap, nil
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Could not read keymap %s", path))
+	}
+	var loaded Keymap
+	if err := json.Unmarshal(contents, &loaded); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Could not parse keymap %s", path))
+	}
+	for action, keys := range loaded.Bindings {
+		if _, found := keymap.Bindings[action]; !found {
+			return nil, errors.New(fmt.Sprintf("Unknown action %s in keymap %s", action, path))
+		}
+		for _, key := range keys {
+			if _, _, err := parseKey(key); err != nil {
+				return nil, errors.Wrap(err, fmt.Sprintf("Invalid key for %s in keymap %s", action, path))
+			}
+		}
+		keymap.Bindings[action] = keys
+	}
+	keymap.Vi = loaded.Vi
+	return keymap, nil
+}
+
+var namedKeys = map[string]gocui.Key{
+	"f1": gocui.KeyF1, "f2": gocui.KeyF2, "f3": gocui.KeyF3, "f4": gocui.KeyF4,
+	"f5": gocui.KeyF5, "f6": gocui.KeyF6, "f7": gocui.KeyF7, "f8": gocui.KeyF8,
+	"f9": gocui.KeyF9, "f10": gocui.KeyF10, "f11": gocui.KeyF11, "f12": gocui.KeyF12,
+	"insert": gocui.KeyInsert, "delete": gocui.KeyDelete,
+	"home": gocui.KeyHome, "end": gocui.KeyEnd,
+	"pgup": gocui.KeyPgup, "pgdn": gocui.KeyPgdn,
+	"up": gocui.KeyArrowUp, "down": gocui.KeyArrowDown,
+	"left": gocui.KeyArrowLeft, "right": gocui.KeyArrowRight,
+	"tab": gocui.KeyTab, "enter": gocui.KeyEnter, "esc": gocui.KeyEsc,
+	"space": gocui.KeySpace, "backspace": gocui.KeyBackspace2,
+}
+
+// parses a key name into the key and modifier gocui binds to.
+// Single characters are case sensitive; everything else is not
+func parseKey(name string) (interface{}, gocui.Modifier, error) {
+	name = strings.TrimSpace(name)
+	mod := gocui.ModNone
+	if strings.HasPrefix(strings.ToLower(name), "alt-") {
+		mod = gocui.ModAlt
+		name = name[len("alt-"):]
+	}
+	lower := strings.ToLower(name)
+	if key, found := namedKeys[lower]; found {
+		return key, mod, nil
+	}
+	if strings.HasPrefix(lower, "ctrl-") {
+		letter := strings.TrimPrefix(lower, "ctrl-")
+		if len(letter) == 1 && letter[0] >= 'a' && letter[0] <= 'z' {
+			return gocui.KeyCtrlA + gocui.Key(letter[0]-'a'), mod, nil
+		}
+	} else if utf8.RuneCountInString(name) == 1 {
+		ch, _ := utf8.DecodeRuneInString(name)
+		return ch, mod, nil
+	}
+	return nil, mod, errors.New(fmt.Sprintf("Unknown key %s", name))
+}
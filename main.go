@@ -3,14 +3,25 @@ package main
 //TODO: want persistent storage for chatroom stuff
 //TODO: call bw.SilenceLog
 import (
+	"context"
+	"fmt"
 	"github.com/codegangsta/cli"
+	"github.com/gtfierro/ordo/core"
 	"github.com/op/go-logging"
+	"github.com/pkg/errors"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 const VERSION = "0.0.1"
+const DefaultAlias = "jf_sebastian"
 const ChatRoomBufSize = 200 // buffer 200 messages
 
+// how long to spend telling rooms we are leaving on exit
+const ShutdownTimeout = 5 * time.Second
+
 var (
 	CreateRoomTopic = "create"
 	log             = logging.MustGetLogger("bw2chat_daemon")
@@ -30,14 +41,73 @@ func startDaemon(c *cli.Context) {
 }
 
 func startClient(c *cli.Context) {
-	client := NewOrdoClient(c.GlobalString("entity"), c.String("alias"))
-	StartUserInterface(client)
-	for _, room := range c.StringSlice("room") {
-		client.runCommand(Command{Type: JoinCommand, Args: []string{room}})
+	profile, err := resolveProfile(c)
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "Invalid configuration"))
+	}
+	client, err := NewOrdoClient(profile.Entity, profile.Alias, profile.Namespace, core.WithOutboxFile(OutboxPath(profile.Name)))
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "Could not start client"))
+	}
+	notifier, err := NewNotifier(profile.Notify, profile.NotifyCommand)
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "Invalid notification settings"))
+	}
+	client.SetNotifier(notifier)
+	session, err := OpenSessionStore(profile.Name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	client.SetSessionStore(session)
+	for _, keyword := range profile.Highlight {
+		client.AddHighlightKeyword(keyword)
+	}
+	for _, expr := range profile.HighlightRegex {
+		if err := client.AddHighlightPattern(expr); err != nil {
+			log.Fatal(errors.Wrap(err, "Invalid highlight regex"))
+		}
+	}
+	theme, err := LoadTheme(profile.Theme)
+	if err != nil {
+		log.Fatal(err)
 	}
-	//TODO: exit cleanly here
-	x := make(chan bool)
-	<-x
+	theme.Apply()
+	renderer, err := NewRenderer(profile.Format, profile.SystemFormat, profile.TimeFormat, theme)
+	if err != nil {
+		log.Fatal(err)
+	}
+	renderer.Self = client.VK()
+	keymap, err := LoadKeymap(profile.Keymap)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ui := StartUserInterface(client, renderer, theme, keymap)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		ui.Quit("")
+	}()
+
+	for _, room := range session.StartupRooms(profile.Autojoin) {
+		ui.changeRoom(Command{Type: JoinCommand, Args: []string{room}})
+	}
+
+	reason, uiErr := ui.Wait()
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	shutdownErr := client.Shutdown(ctx, reason)
+	cancel()
+	ui.Close()
+
+	status := 0
+	for _, err := range []error{uiErr, shutdownErr} {
+		if err != nil {
+			log.Error(err)
+			status = 1
+		}
+	}
+	os.Exit(status)
 }
 
 func main() {
@@ -55,7 +125,15 @@ func main() {
 		cli.StringFlag{
 			Name:  "namespace,n",
 			Value: "gabe.ns/chatrooms/",
-			Usage: "Root namespace for chatrooms",
+			Usage: "Root namespace for chatrooms. Rooms joined by name alone are looked up under <namespace>room/",
+		},
+		cli.StringFlag{
+			Name:  "config,c",
+			Usage: fmt.Sprintf("Configuration file (default %s)", DefaultConfigPath()),
+		},
+		cli.StringFlag{
+			Name:  "profile,p",
+			Usage: "Profile from the configuration file to use. Flags override its values",
 		},
 	}
 
@@ -72,7 +150,7 @@ func main() {
 			Flags: []cli.Flag{
 				cli.StringFlag{
 					Name:  "alias,nickname",
-					Value: "jf_sebastian",
+					Value: DefaultAlias,
 					Usage: "Nickname to use",
 				},
 				cli.StringSliceFlag{
@@ -80,6 +158,202 @@ func main() {
 					Value: &cli.StringSlice{},
 					Usage: "List of rooms to join on startup. Use a new -r for each room",
 				},
+				cli.StringSliceFlag{
+					Name:  "highlight",
+					Value: &cli.StringSlice{},
+					Usage: "Highlight messages containing this word. Your alias is always highlighted",
+				},
+				cli.StringSliceFlag{
+					Name:  "highlight-regex",
+					Value: &cli.StringSlice{},
+					Usage: "Highlight messages matching this regular expression",
+				},
+				cli.StringFlag{
+					Name:  "notify",
+					Value: "none",
+					Usage: "How to alert on mentions in other rooms: none, bell, osc9, osc777 or command",
+				},
+				cli.StringFlag{
+					Name:  "notify-command",
+					Usage: "Command run for --notify command. Receives the notification as JSON on stdin",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: DefaultMessageFormat,
+					Usage: "Template for chat lines. Fields: .Time .From .FromVK .Room .Message",
+				},
+				cli.StringFlag{
+					Name:  "system-format",
+					Value: DefaultSystemFormat,
+					Usage: "Template for system lines. Same fields as --format",
+				},
+				cli.StringFlag{
+					Name:  "time-format",
+					Value: DefaultTimeFormat,
+					Usage: "Go time layout used for .Time",
+				},
+				cli.StringFlag{
+					Name:  "theme",
+					Value: "default",
+					Usage: "Built-in theme (default, dark, light, mono) or path to a JSON theme file. A non-empty NO_COLOR forces mono",
+				},
+				cli.StringFlag{
+					Name:  "keymap",
+					Usage: "Path to a JSON keymap file mapping actions to keys. Unmapped actions keep their defaults",
+				},
+			},
+		},
+		{
+			Name:      "send",
+			Usage:     "Send one message to a room and exit",
+			ArgsUsage: "[message|-]",
+			Description: fmt.Sprintf("Sends the arguments as one message, or standard input if the only argument is -. "+
+				"Exits %d on bad usage, %d on an empty message, %d if the agent or entity cannot be used, "+
+				"%d if standard input cannot be read and %d if the message could not be sent",
+				ExitUsage, ExitDataErr, ExitUnavailable, ExitIOErr, ExitTempFail),
+			Action: sendMessage,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "room, r",
+					Usage: "Room to send to: a URI, or a name under <namespace>room/",
+				},
+				cli.StringFlag{
+					Name:  "alias,nickname",
+					Value: DefaultAlias,
+					Usage: "Nickname to use",
+				},
+				cli.DurationFlag{
+					Name:  "timeout",
+					Value: 10 * time.Second,
+					Usage: "How long to wait for the message to be sent",
+				},
+			},
+		},
+		{
+			Name:  "pipe",
+			Usage: "Send each line of standard input to a room",
+			Description: fmt.Sprintf("Sends lines from standard input until it ends, gathering bursts of lines into one message. "+
+				"Exits %d on bad usage, %d if the agent or entity cannot be used, %d if standard input cannot be read and %d if a message could not be sent",
+				ExitUsage, ExitUnavailable, ExitIOErr, ExitTempFail),
+			Action: pipeLines,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "room, r",
+					Usage: "Room to send to: a URI, or a name under <namespace>room/",
+				},
+				cli.StringFlag{
+					Name:  "alias,nickname",
+					Value: DefaultAlias,
+					Usage: "Nickname to use",
+				},
+				cli.DurationFlag{
+					Name:  "batch",
+					Value: 500 * time.Millisecond,
+					Usage: "Lines arriving this soon after the first of a burst are sent with it as one message",
+				},
+				cli.IntFlag{
+					Name:  "max-lines",
+					Value: 20,
+					Usage: "Most lines to put in one message",
+				},
+				cli.DurationFlag{
+					Name:  "rate",
+					Value: time.Second,
+					Usage: "Least time between messages. Input is read no faster than it can be sent",
+				},
+				cli.DurationFlag{
+					Name:  "timeout",
+					Value: 10 * time.Second,
+					Usage: "How long to wait for each message to be sent",
+				},
+			},
+		},
+		{
+			Name:  "tail",
+			Usage: "Print what happens in rooms until interrupted",
+			Description: fmt.Sprintf("Joins the rooms and prints each chat message, join, leave, nick change and topic change as a line. "+
+				"Exits %d on bad usage, %d if the agent or entity cannot be used or a room cannot be joined and %d if output cannot be written",
+				ExitUsage, ExitUnavailable, ExitIOErr),
+			Action: tailRooms,
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "room, r",
+					Value: &cli.StringSlice{},
+					Usage: "Room to tail: a URI, or a name under <namespace>room/. Use a new -r for each room",
+				},
+				cli.StringFlag{
+					Name:  "output, o",
+					Value: "json",
+					Usage: "Output format: json (one object per line), logfmt or plain",
+				},
+				cli.BoolFlag{
+					Name:  "quiet, q",
+					Usage: "Join without announcing it, so others do not see you in the room",
+				},
+				cli.StringFlag{
+					Name:  "alias,nickname",
+					Value: DefaultAlias,
+					Usage: "Nickname to use",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: DefaultTailFormat,
+					Usage: "Template for chat lines with --output plain. Fields: .Time .From .FromVK .Room .Message",
+				},
+				cli.StringFlag{
+					Name:  "system-format",
+					Value: DefaultTailSystemFormat,
+					Usage: "Template for other lines with --output plain. Same fields as --format",
+				},
+				cli.StringFlag{
+					Name:  "time-format",
+					Value: DefaultTailTimeFormat,
+					Usage: "Go time layout used for .Time",
+				},
+				cli.DurationFlag{
+					Name:  "timeout",
+					Value: 10 * time.Second,
+					Usage: "How long joining the rooms may take",
+				},
+			},
+		},
+		{
+			Name:  "serve",
+			Usage: "Serve an HTTP API for joining rooms, posting and reading messages",
+			Description: "Endpoints: GET /rooms lists joined rooms; POST /rooms {\"room\": ...} joins one; DELETE /rooms?room=...&reason=... leaves one; " +
+				"GET /messages?room=...[&since=clock][&limit=n] returns what a joined room has seen; POST /messages?room=... posts the body; " +
+				"GET /members?room=... lists the members of a joined room. Rooms are URIs, or names under <namespace>room/",
+			Action: serveAPI,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "http",
+					Value: "localhost:8080",
+					Usage: "Address to listen on. Anyone who can reach it can chat as you",
+				},
+				cli.StringSliceFlag{
+					Name:  "room, r",
+					Value: &cli.StringSlice{},
+					Usage: "Room to join on startup. Use a new -r for each room",
+				},
+				cli.StringFlag{
+					Name:  "alias,nickname",
+					Value: DefaultAlias,
+					Usage: "Nickname to use",
+				},
+				cli.BoolFlag{
+					Name:  "quiet, q",
+					Usage: "Join without announcing it, so others do not see you in the room",
+				},
+				cli.IntFlag{
+					Name:  "history",
+					Value: DefaultServeHistory,
+					Usage: "Messages to keep per room for GET /messages",
+				},
+				cli.DurationFlag{
+					Name:  "timeout",
+					Value: 10 * time.Second,
+					Usage: "How long a request may wait on the agent",
+				},
 			},
 		},
 	}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gtfierro/ordo/core"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"os/exec"
+)
+
+type NotifyMethod uint8
+
+const (
+	NotifyNone NotifyMethod = iota
+	// ring the terminal bell
+	NotifyBell
+	// OSC 9 desktop notification (iTerm2, ConEmu, Windows Terminal)
+	NotifyOSC9
+	// OSC 777 desktop notification (urxvt, VTE-based terminals)
+	NotifyOSC777
+	// run an external command with the notification as JSON on stdin
+	NotifyCommand
+)
+
+func (nm NotifyMethod) String() string {
+	switch nm {
+	case NotifyNone:
+		return "none"
+	case NotifyBell:
+		return "bell"
+	case NotifyOSC9:
+		return "osc9"
+	case NotifyOSC777:
+		return "osc777"
+	case NotifyCommand:
+		return "command"
+	default:
+		return "unknown"
+	}
+}
+
+func notifyMethodFromString(s string) (NotifyMethod, error) {
+	switch s {
+	case "", "none":
+		return NotifyNone, nil
+	case "bell":
+		return NotifyBell, nil
+	case "osc9":
+		return NotifyOSC9, nil
+	case "osc777":
+		return NotifyOSC777, nil
+	case "command":
+		return NotifyCommand, nil
+	}
+	return NotifyNone, errors.New(fmt.Sprintf("Unknown notification method %s", s))
+}
+
+// the JSON object written to the stdin of a notification command
+type Notification struct {
+	Room    string `json:"room"`
+	From    string `json:"from"`
+	FromVK  string `json:"from_vk"`
+	Message string `json:"message"`
+	Mention bool   `json:"mention"`
+}
+
+// alerts the user to messages arriving in rooms they are not looking at
+type Notifier struct {
+	Method NotifyMethod
+	// shell command to run for NotifyCommand
+	Command string
+	// where escape sequences are written
+	terminal io.Writer
+}
+
+func NewNotifier(method, command string) (*Notifier, error) {
+	nm, err := notifyMethodFromString(method)
+	if err != nil {
+		return nil, err
+	}
+	if nm == NotifyCommand && len(command) == 0 {
+		return nil, errors.New("Notification method 'command' needs a command to run")
+	}
+	return &Notifier{
+		Method:   nm,
+		Command:  command,
+		terminal: os.Stdout,
+	}, nil
+}
+
+func (n *Notifier) Notify(msg core.Message) error {
+	var room string
+	if msg.Room != nil {
+		room = msg.Room.URI
+	}
+	title := fmt.Sprintf("bw2chat %s", room)
+	body := fmt.Sprintf("%s: %s", msg.From, msg.Message)
+	switch n.Method {
+	case NotifyBell:
+		_, err := fmt.Fprint(n.terminal, "\a")
+		return err
+	case NotifyOSC9:
+		_, err := fmt.Fprintf(n.terminal, "\x1b]9;%s\x07", sanitizeEscape(title+": "+body))
+		return err
+	case NotifyOSC777:
+		_, err := fmt.Fprintf(n.terminal, "\x1b]777;notify;%s;%s\x07", sanitizeEscape(title), sanitizeEscape(body))
+		return err
+	case NotifyCommand:
+		payload, err := json.Marshal(Notification{
+			Room:    room,
+			From:    msg.From,
+			FromVK:  msg.FromVK,
+			Message: msg.Message,
+			Mention: msg.Mention,
+		})
+		if err != nil {
+			return errors.Wrap(err, "Could not encode notification")
+		}
+		cmd := exec.Command("sh", "-c", n.Command)
+		cmd.Stdin = bytes.NewReader(payload)
+		if err := cmd.Run(); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("Notification command %s failed", n.Command))
+		}
+	}
+	return nil
+}
+
+// strips control characters and ';' so message contents cannot terminate the escape sequence early
+func sanitizeEscape(s string) string {
+	return string(bytes.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == ';' {
+			return ' '
+		}
+		return r
+	}, []byte(s)))
+}
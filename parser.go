@@ -1,6 +1,7 @@
 package main
 
 import (
+	"sort"
 	"strings"
 )
 
@@ -23,6 +24,13 @@ const (
 	SendCommand
 	ListJoinedRoomsCommand
 	HelpCommand
+	MentionsCommand
+	AutojoinCommand
+	QuitCommand
+	RetryCommand
+	DiscardCommand
+	EventsCommand
+	TopicCommand
 	ERRORCommand
 )
 
@@ -38,6 +46,20 @@ func (ct CommandType) String() string {
 		return "ListJoinedRooms"
 	case HelpCommand:
 		return "Help"
+	case MentionsCommand:
+		return "Mentions"
+	case AutojoinCommand:
+		return "Autojoin"
+	case QuitCommand:
+		return "Quit"
+	case RetryCommand:
+		return "Retry"
+	case DiscardCommand:
+		return "Discard"
+	case EventsCommand:
+		return "Events"
+	case TopicCommand:
+		return "Topic"
 	case ERRORCommand:
 		return "Error"
 	default:
@@ -45,20 +67,36 @@ func (ct CommandType) String() string {
 	}
 }
 
-func commandFromString(s string) (c CommandType) {
-	switch strings.TrimSpace(s[1:]) {
-	case "join":
-		c = JoinCommand
-	case "leave":
-		c = LeaveCommand
-	case "listjoined":
-		c = ListJoinedRoomsCommand
-	case "help":
-		c = HelpCommand
-	default:
-		c = ERRORCommand
+// registry of the '\' commands understood by the parser
+var commandNames = map[string]CommandType{
+	"join":       JoinCommand,
+	"leave":      LeaveCommand,
+	"listjoined": ListJoinedRoomsCommand,
+	"help":       HelpCommand,
+	"mentions":   MentionsCommand,
+	"autojoin":   AutojoinCommand,
+	"quit":       QuitCommand,
+	"retry":      RetryCommand,
+	"discard":    DiscardCommand,
+	"events":     EventsCommand,
+	"topic":      TopicCommand,
+}
+
+// returns the names of all registered commands, including the leading '\', sorted
+func CommandNames() []string {
+	names := make([]string, 0, len(commandNames))
+	for name := range commandNames {
+		names = append(names, "\\"+name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func commandFromString(s string) CommandType {
+	if c, found := commandNames[strings.TrimSpace(s[1:])]; found {
+		return c
 	}
-	return
+	return ERRORCommand
 }
 
 type Command struct {
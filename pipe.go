@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"github.com/codegangsta/cli"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// reads lines from r onto the returned channel, which is closed at the end of
+// input. A read error other than EOF is sent on errs
+func readLines(r io.Reader, errs chan<- error) <-chan string {
+	lines := make(chan string, 100)
+	go func() {
+		defer close(lines)
+		reader := bufio.NewReader(r)
+		for {
+			line, err := reader.ReadString('\n')
+			if line = strings.TrimRight(line, "\r\n"); len(strings.TrimSpace(line)) > 0 {
+				lines <- line
+			}
+			if err == io.EOF {
+				return
+			} else if err != nil {
+				errs <- errors.Wrap(err, "Could not read stdin")
+				return
+			}
+		}
+	}()
+	return lines
+}
+
+// pipeBatcher gathers lines into messages. Lines arriving within the batch window
+// of the first one go out together, up to maxLines, and messages are sent no more
+// often than once per interval. Lines arriving while we wait make up the next message.
+// The batcher never waits itself; due says when the next message should be sent
+type pipeBatcher struct {
+	window   time.Duration
+	maxLines int
+	interval time.Duration
+	send     func(text string) error
+	now      func() time.Time
+
+	batch []string
+	// when the batch window of the first line in the batch is over
+	windowEnd time.Time
+	// earliest the next message may be sent
+	next time.Time
+}
+
+func newPipeBatcher(window time.Duration, maxLines int, interval time.Duration, send func(text string) error) *pipeBatcher {
+	return &pipeBatcher{window: window, maxLines: maxLines, interval: interval, send: send, now: time.Now}
+}
+
+func (p *pipeBatcher) add(line string) {
+	if len(p.batch) == 0 {
+		p.windowEnd = p.now().Add(p.window)
+	}
+	p.batch = append(p.batch, line)
+}
+
+// stops waiting for more lines, so what is left is due as soon as the rate allows
+func (p *pipeBatcher) close() {
+	p.windowEnd = p.now()
+}
+
+// returns how long until the next message should be sent, or false if there is
+// nothing to send
+func (p *pipeBatcher) due() (time.Duration, bool) {
+	if len(p.batch) == 0 {
+		return 0, false
+	}
+	now := p.now()
+	at := p.windowEnd
+	if len(p.batch) >= p.maxLines {
+		at = now
+	}
+	if p.next.After(at) {
+		at = p.next
+	}
+	return at.Sub(now), true
+}
+
+// sends up to maxLines lines of the batch as one message, whether or not it is
+// due. The rest are due as soon as the rate allows
+func (p *pipeBatcher) flush() error {
+	if len(p.batch) == 0 {
+		return nil
+	}
+	n := len(p.batch)
+	if n > p.maxLines {
+		n = p.maxLines
+	}
+	text := strings.Join(p.batch[:n], "\n")
+	if p.batch = p.batch[n:]; len(p.batch) == 0 {
+		p.batch = nil
+	}
+	now := p.now()
+	p.windowEnd = now
+	p.next = now.Add(p.interval)
+	return p.send(text)
+}
+
+func pipeLines(c *cli.Context) {
+	profile := headlessProfile(c)
+	roomURI := headlessRooms(profile, []string{c.String("room")})[0]
+	if c.Int("max-lines") < 1 {
+		exitWith(ExitUsage, errors.New("--max-lines must be at least 1"))
+	}
+	ordo := headlessCore(profile)
+
+	batcher := newPipeBatcher(c.Duration("batch"), c.Int("max-lines"), c.Duration("rate"), func(text string) error {
+		ctx, cancel := context.WithTimeout(context.Background(), c.Duration("timeout"))
+		defer cancel()
+		return ordo.Post(ctx, roomURI, text)
+	})
+
+	readErrs := make(chan error, 1)
+	lines := readLines(os.Stdin, readErrs)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	for {
+		wait, pending := batcher.due()
+		if !pending && lines == nil {
+			// the end of input, and everything read has been sent
+			select {
+			case err := <-readErrs:
+				exitWith(ExitIOErr, err)
+			default:
+			}
+			return
+		}
+		if pending && wait <= 0 {
+			if err := batcher.flush(); err != nil {
+				exitWith(ExitTempFail, err)
+			}
+			continue
+		}
+		// fires once the batch is due
+		var (
+			timer *time.Timer
+			ready <-chan time.Time
+		)
+		if pending {
+			timer = time.NewTimer(wait)
+			ready = timer.C
+		}
+		select {
+		case line, more := <-lines:
+			if more {
+				batcher.add(line)
+			} else {
+				lines = nil
+				batcher.close()
+			}
+		case <-ready:
+		case <-signals:
+			// send what we have without waiting out the rate, then stop
+			for len(batcher.batch) > 0 {
+				if err := batcher.flush(); err != nil {
+					exitWith(ExitTempFail, err)
+				}
+			}
+			return
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a batcher on a clock that only moves when told to, recording what it sends
+type testBatcher struct {
+	*pipeBatcher
+	clock time.Time
+	sent  []string
+}
+
+func newTestBatcher(window time.Duration, maxLines int, interval time.Duration) *testBatcher {
+	tb := &testBatcher{clock: time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)}
+	tb.pipeBatcher = newPipeBatcher(window, maxLines, interval, func(text string) error {
+		tb.sent = append(tb.sent, text)
+		return nil
+	})
+	tb.now = func() time.Time { return tb.clock }
+	return tb
+}
+
+// checks how long until the batcher has something to send
+func (tb *testBatcher) checkDue(t *testing.T, want time.Duration) {
+	t.Helper()
+	wait, pending := tb.due()
+	if !pending {
+		t.Fatalf("Nothing due, want a message in %s", want)
+	}
+	if wait != want {
+		t.Errorf("Due in %s, want %s", wait, want)
+	}
+}
+
+func (tb *testBatcher) checkIdle(t *testing.T) {
+	t.Helper()
+	if wait, pending := tb.due(); pending {
+		t.Errorf("Message due in %s, want nothing", wait)
+	}
+}
+
+func TestPipeBatcherWindow(t *testing.T) {
+	tb := newTestBatcher(500*time.Millisecond, 10, time.Second)
+	tb.checkIdle(t)
+	tb.add("one")
+	tb.clock = tb.clock.Add(200 * time.Millisecond)
+	tb.add("two")
+	// the window runs from the first line
+	tb.checkDue(t, 300*time.Millisecond)
+	tb.clock = tb.clock.Add(300 * time.Millisecond)
+	tb.checkDue(t, 0)
+	if err := tb.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(tb.sent) != fmt.Sprint([]string{"one\ntwo"}) {
+		t.Errorf("Sent %q, want one message of both lines", tb.sent)
+	}
+	tb.checkIdle(t)
+}
+
+func TestPipeBatcherMaxLines(t *testing.T) {
+	tb := newTestBatcher(500*time.Millisecond, 2, time.Second)
+	for _, line := range []string{"1", "2", "3", "4", "5"} {
+		tb.add(line)
+	}
+	// a full batch does not wait for the window
+	tb.checkDue(t, 0)
+	tb.flush()
+	// the rest wait out the rate, but not another window
+	tb.checkDue(t, time.Second)
+	tb.clock = tb.clock.Add(time.Second)
+	tb.checkDue(t, 0)
+	tb.flush()
+	tb.clock = tb.clock.Add(time.Second)
+	tb.flush()
+	tb.checkIdle(t)
+	if want := []string{"1\n2", "3\n4", "5"}; fmt.Sprint(tb.sent) != fmt.Sprint(want) {
+		t.Errorf("Sent %q, want %q", tb.sent, want)
+	}
+}
+
+func TestPipeBatcherRate(t *testing.T) {
+	tb := newTestBatcher(100*time.Millisecond, 10, time.Second)
+	tb.add("first")
+	tb.clock = tb.clock.Add(100 * time.Millisecond)
+	tb.flush()
+
+	tb.clock = tb.clock.Add(50 * time.Millisecond)
+	tb.add("second")
+	// the window is over before the rate allows another message
+	tb.checkDue(t, 950*time.Millisecond)
+	tb.clock = tb.clock.Add(900 * time.Millisecond)
+	tb.add("third")
+	tb.checkDue(t, 50*time.Millisecond)
+
+	// long after the last message, only the window applies
+	tb.clock = tb.clock.Add(50 * time.Millisecond)
+	tb.flush()
+	tb.clock = tb.clock.Add(time.Hour)
+	tb.add("fourth")
+	tb.checkDue(t, 100*time.Millisecond)
+}
+
+func TestPipeBatcherClose(t *testing.T) {
+	tb := newTestBatcher(500*time.Millisecond, 10, time.Second)
+	tb.add("last")
+	tb.close()
+	tb.checkDue(t, 0)
+
+	tb.flush()
+	tb.add("after")
+	tb.close()
+	// still rate limited
+	tb.checkDue(t, time.Second)
+}
+
+func TestPipeBatcherSendError(t *testing.T) {
+	refused := errors.New("publish refused")
+	p := newPipeBatcher(0, 10, 0, func(string) error { return refused })
+	if err := p.flush(); err != nil {
+		t.Errorf("Flushing nothing failed: %s", err)
+	}
+	p.add("hello")
+	if err := p.flush(); err != refused {
+		t.Errorf("Flush returned %v, want %v", err, refused)
+	}
+}
+
+func TestReadLines(t *testing.T) {
+	errs := make(chan error, 1)
+	var got []string
+	for line := range readLines(strings.NewReader("one\r\n\n  \ntwo\nthree"), errs) {
+		got = append(got, line)
+	}
+	if want := []string{"one", "two", "three"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Read %q, want %q", got, want)
+	}
+	select {
+	case err := <-errs:
+		t.Errorf("Read error %s at end of input", err)
+	default:
+	}
+
+	for range readLines(brokenReader{}, errs) {
+	}
+	select {
+	case <-errs:
+	default:
+		t.Error("Read error not reported")
+	}
+}
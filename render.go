@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/gtfierro/ordo/core"
+	"github.com/pkg/errors"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	DefaultMessageFormat = "{{.Time}} [{{.From}}]> {{.Message}}"
+	DefaultSystemFormat  = "{{.Time}} -!- {{.Message}}"
+	DefaultTimeFormat    = "15:04"
+	daySeparatorFormat   = "--- Mon, 02 Jan 2006 ---"
+)
+
+// colors nicks are drawn in, chosen by hashing the sender's VK
+var nickColors = []*color.Color{
+	color.New(color.FgRed),
+	color.New(color.FgGreen),
+	color.New(color.FgYellow),
+	color.New(color.FgBlue),
+	color.New(color.FgMagenta),
+	color.New(color.FgCyan),
+	color.New(color.FgRed, color.Bold),
+	color.New(color.FgGreen, color.Bold),
+	color.New(color.FgYellow, color.Bold),
+	color.New(color.FgBlue, color.Bold),
+	color.New(color.FgMagenta, color.Bold),
+	color.New(color.FgCyan, color.Bold),
+}
+
+// the fields available to message and system format templates
+type renderContext struct {
+	Time    string
+	From    string
+	FromVK  string
+	Room    string
+	Message string
+}
+
+// Renderer turns messages into display lines using configurable templates.
+// It remembers the day of the last rendered message so it can insert a separator
+// when the date changes, so each output should have its own Renderer
+type Renderer struct {
+	message    *template.Template
+	system     *template.Template
+	timeFormat string
+	theme      *Theme
+	// whether to emit color escape sequences
+	Color bool
+	// our VK, so our own messages can be styled differently
+	Self string
+
+	lock    sync.Mutex
+	lastDay string
+}
+
+func NewRenderer(messageFormat, systemFormat, timeFormat string, theme *Theme) (*Renderer, error) {
+	msgTmpl, err := template.New("message").Parse(messageFormat)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid message format")
+	}
+	sysTmpl, err := template.New("system").Parse(systemFormat)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid system message format")
+	}
+	return &Renderer{
+		message:    msgTmpl,
+		system:     sysTmpl,
+		timeFormat: timeFormat,
+		theme:      theme,
+		Color:      !theme.Monochrome,
+	}, nil
+}
+
+// returns the lines to display for msg: a day separator if the date changed since
+// the last message, followed by the message itself
+func (r *Renderer) Render(msg core.Message) []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	when := msg.Time
+	if when.IsZero() {
+		when = time.Now()
+	}
+	lines := r.daySeparator(when)
+
+	ctx := renderContext{
+		Time:    when.Format(r.timeFormat),
+		From:    msg.From,
+		FromVK:  msg.FromVK,
+		Message: msg.Message,
+	}
+	if msg.Room != nil {
+		ctx.Room = msg.Room.Name
+	}
+	if msg.Kind != core.ChatKind {
+		// joins, leaves and the like are told like notices
+		return append(lines, r.execute(r.system, ctx))
+	}
+	if r.Color {
+		ctx.From = r.nickColor(msg.FromVK, msg.From).SprintFunc()(msg.From)
+	}
+	line := r.execute(r.message, ctx)
+	if msg.Mention {
+		line = r.colorize(printMention, line)
+	}
+	return append(lines, line)
+}
+
+// like Render, but for notices from the client, which use the system format
+func (r *Renderer) RenderNotice(notice Notice) []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	when := notice.Time
+	if when.IsZero() {
+		when = time.Now()
+	}
+	lines := r.daySeparator(when)
+	return append(lines, r.execute(r.system, renderContext{
+		Time:    when.Format(r.timeFormat),
+		Message: notice.Text,
+	}))
+}
+
+// renders the local echo of a message we are sending, marked with its state. These
+// lines are replaced as the state changes, so they never get a day separator
+func (r *Renderer) RenderOutbound(item core.Outbound, alias string) string {
+	ctx := renderContext{
+		Time:    item.Queued.Format(r.timeFormat),
+		From:    alias,
+		Message: item.Message,
+	}
+	if idx := strings.LastIndex(item.RoomURI, "/"); idx >= 0 {
+		ctx.Room = item.RoomURI[idx:]
+	}
+	line := r.execute(r.message, ctx)
+	if item.State == core.Failed {
+		return r.colorize(printError, fmt.Sprintf("%s  [failed: %s; \\retry %d or \\discard %d]", line, item.LastError, item.ID, item.ID))
+	}
+	if item.State == core.Sent {
+		return r.colorize(printInfo, line+"  [sent]")
+	}
+	if item.Attempts > 0 {
+		return r.colorize(printInfo, fmt.Sprintf("%s  [sending, attempt %d: %s]", line, item.Attempts+1, item.LastError))
+	}
+	return r.colorize(printInfo, line+"  [sending]")
+}
+
+// returns a separator line if when is on a different day than the last thing rendered
+func (r *Renderer) daySeparator(when time.Time) []string {
+	day := when.Format("2006-01-02")
+	if day == r.lastDay {
+		return nil
+	}
+	first := len(r.lastDay) == 0
+	r.lastDay = day
+	if first {
+		return nil
+	}
+	return []string{r.colorize(printInfo, when.Format(daySeparatorFormat))}
+}
+
+// fills in the template, falling back to the bare message text if it fails
+func (r *Renderer) execute(tmpl *template.Template, ctx renderContext) string {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, ctx); err != nil {
+		log.Error(errors.Wrap(err, "Could not render message"))
+		return ctx.Message
+	}
+	return buf.String()
+}
+
+func (r *Renderer) colorize(fxn func(a ...interface{}) string, s string) string {
+	if !r.Color {
+		return s
+	}
+	return fxn(s)
+}
+
+// picks the color for a sender's nick from the theme, or a stable color hashed
+// from their VK (falling back to their alias if the VK is unknown)
+func (r *Renderer) nickColor(vk, alias string) *color.Color {
+	if len(vk) > 0 && vk == r.Self {
+		return r.theme.Color(r.theme.OwnMessage)
+	}
+	if len(r.theme.OtherMessage) > 0 {
+		return r.theme.Color(r.theme.OtherMessage)
+	}
+	h := fnv.New32a()
+	if len(vk) > 0 {
+		h.Write([]byte(vk))
+	} else {
+		h.Write([]byte(alias))
+	}
+	return nickColors[h.Sum32()%uint32(len(nickColors))]
+}
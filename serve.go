@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"github.com/gtfierro/ordo/core"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// messages kept per room for GET /messages unless --history says otherwise
+const DefaultServeHistory = 1000
+
+// keeps the most recent messages of each room
+type messageHistory struct {
+	sync.Mutex
+	max   int
+	rooms map[string][]core.Message
+}
+
+func newMessageHistory(max int) *messageHistory {
+	return &messageHistory{max: max, rooms: make(map[string][]core.Message)}
+}
+
+func (h *messageHistory) add(msg core.Message) {
+	h.Lock()
+	defer h.Unlock()
+	msgs := append(h.rooms[msg.Room.URI], msg)
+	if len(msgs) > h.max {
+		msgs = msgs[len(msgs)-h.max:]
+	}
+	h.rooms[msg.Room.URI] = msgs
+}
+
+// returns up to limit of the latest messages in the room with a clock after since
+func (h *messageHistory) get(roomURI string, since uint64, limit int) []core.Message {
+	h.Lock()
+	defer h.Unlock()
+	var found []core.Message
+	for _, msg := range h.rooms[roomURI] {
+		if msg.Clock > since {
+			found = append(found, msg)
+		}
+	}
+	if limit > 0 && len(found) > limit {
+		found = found[len(found)-limit:]
+	}
+	return found
+}
+
+// a joined room as listed by GET /rooms
+type roomRecord struct {
+	URI     string `json:"uri"`
+	Name    string `json:"name"`
+	Topic   string `json:"topic,omitempty"`
+	Members int32  `json:"members"`
+}
+
+// the count comes from the member list so the two endpoints always agree
+func newRoomRecord(state core.RoomState) roomRecord {
+	return roomRecord{URI: state.URI, Name: state.Name, Topic: state.Topic, Members: int32(len(state.Members))}
+}
+
+type memberRecord struct {
+	VK       string    `json:"vk"`
+	Alias    string    `json:"alias"`
+	Role     string    `json:"role"`
+	Presence string    `json:"presence"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// like the lines of tail --output json
+func messageRecord(msg core.Message) tailRecord {
+	return tailRecord{Time: msg.Time, Type: msg.Kind.String(), Room: msg.Room.URI, From: msg.From, FromVK: msg.FromVK,
+		Message: msg.Message, ID: msg.ID, Clock: msg.Clock, Mention: msg.Mention, room: msg.Room, kind: msg.Kind}
+}
+
+// apiServer is the HTTP interface of bw2chat serve. Rooms are named with the room
+// query parameter, or the room field of a JSON body, as a URI or a name under the
+// namespace
+type apiServer struct {
+	ordo      *core.OrdoCore
+	namespace string
+	// how long a request may wait on the agent
+	timeout time.Duration
+	history *messageHistory
+	// every joined room is tailed here to fill history
+	messages chan core.Message
+}
+
+func newAPIServer(ordo *core.OrdoCore, namespace string, timeout time.Duration, historySize int) *apiServer {
+	srv := &apiServer{
+		ordo:      ordo,
+		namespace: namespace,
+		timeout:   timeout,
+		history:   newMessageHistory(historySize),
+		messages:  make(chan core.Message, 100),
+	}
+	go func() {
+		for msg := range srv.messages {
+			srv.history.add(msg)
+		}
+	}()
+	return srv
+}
+
+func (srv *apiServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rooms", srv.rooms)
+	mux.HandleFunc("/messages", srv.roomMessages)
+	mux.HandleFunc("/members", srv.members)
+	return mux
+}
+
+func (srv *apiServer) join(ctx context.Context, room string) (*core.Room, error) {
+	joined, err := srv.ordo.JoinRoom(ctx, expandRoomURI(srv.namespace, room))
+	if err != nil {
+		return nil, err
+	}
+	joined.StartTail(srv.messages)
+	return joined, nil
+}
+
+// the joined room named by the room query parameter. Writes the error response
+// and returns nil if there is none
+func (srv *apiServer) joinedRoom(w http.ResponseWriter, r *http.Request) *core.Room {
+	name := strings.TrimSpace(r.URL.Query().Get("room"))
+	if len(name) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("room parameter is required"))
+		return nil
+	}
+	uri := expandRoomURI(srv.namespace, name)
+	for _, room := range srv.ordo.GetRooms() {
+		if room.URI == uri && room.IsAlive() {
+			return room
+		}
+	}
+	writeError(w, http.StatusNotFound, errors.New(fmt.Sprintf("Not in room %s", uri)))
+	return nil
+}
+
+// GET lists joined rooms, POST {"room": ...} joins a room and DELETE
+// ?room=...&reason=... leaves one
+func (srv *apiServer) rooms(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), srv.timeout)
+	defer cancel()
+	switch r.Method {
+	case http.MethodGet:
+		rooms := []roomRecord{}
+		for _, room := range srv.ordo.GetRooms() {
+			if !room.IsAlive() {
+				continue
+			}
+			rooms = append(rooms, newRoomRecord(room.State()))
+		}
+		writeJSON(w, http.StatusOK, rooms)
+	case http.MethodPost:
+		var body struct {
+			Room string `json:"room"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(strings.TrimSpace(body.Room)) == 0 {
+			writeError(w, http.StatusBadRequest, errors.New(`Expected a JSON body like {"room": "general"}`))
+			return
+		}
+		room, err := srv.join(ctx, strings.TrimSpace(body.Room))
+		if err != nil {
+			writeAgentError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, newRoomRecord(room.State()))
+	case http.MethodDelete:
+		room := srv.joinedRoom(w, r)
+		if room == nil {
+			return
+		}
+		// keeps feeding history unless the room is really left
+		if err := room.Leave(ctx, r.URL.Query().Get("reason")); err != nil {
+			writeAgentError(w, err)
+			return
+		}
+		room.StopTail()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPost, http.MethodDelete)
+	}
+}
+
+// GET ?room=...[&since=clock][&limit=n] returns what the room saw since joining,
+// oldest first. POST ?room=... posts the JSON {"message": ...} or the plain text body
+func (srv *apiServer) roomMessages(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		room := srv.joinedRoom(w, r)
+		if room == nil {
+			return
+		}
+		query := r.URL.Query()
+		var (
+			since uint64
+			limit int
+			err   error
+		)
+		if s := query.Get("since"); len(s) > 0 {
+			if since, err = strconv.ParseUint(s, 10, 64); err != nil {
+				writeError(w, http.StatusBadRequest, errors.New("since must be the clock of a message"))
+				return
+			}
+		}
+		if s := query.Get("limit"); len(s) > 0 {
+			if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+				writeError(w, http.StatusBadRequest, errors.New("limit must be a number"))
+				return
+			}
+		}
+		records := []tailRecord{}
+		for _, msg := range srv.history.get(room.URI, since, limit) {
+			records = append(records, messageRecord(msg))
+		}
+		writeJSON(w, http.StatusOK, records)
+	case http.MethodPost:
+		name := strings.TrimSpace(r.URL.Query().Get("room"))
+		if len(name) == 0 {
+			writeError(w, http.StatusBadRequest, errors.New("room parameter is required"))
+			return
+		}
+		text, err := requestMessage(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), srv.timeout)
+		defer cancel()
+		// posting does not need the room to be joined
+		if err := srv.ordo.Post(ctx, expandRoomURI(srv.namespace, name), text); err != nil {
+			writeAgentError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+// the message in a POST /messages body
+func requestMessage(r *http.Request) (string, error) {
+	contents, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "Could not read request")
+	}
+	text := string(contents)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var body struct {
+			Message string `json:"message"`
+		}
+		if err := json.Unmarshal(contents, &body); err != nil {
+			return "", errors.New(`Expected a JSON body like {"message": "hello"}`)
+		}
+		text = body.Message
+	}
+	if len(strings.TrimSpace(text)) == 0 {
+		return "", errors.New("Message is empty")
+	}
+	return strings.TrimRight(text, "\r\n"), nil
+}
+
+// GET ?room=... returns the known members of a joined room
+func (srv *apiServer) members(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	room := srv.joinedRoom(w, r)
+	if room == nil {
+		return
+	}
+	now := time.Now()
+	members := []memberRecord{}
+	for _, member := range room.State().Members {
+		members = append(members, memberRecord{
+			VK:       member.VK,
+			Alias:    member.Alias,
+			Role:     member.Role.String(),
+			Presence: member.Presence(now).String(),
+			LastSeen: member.LastSeen,
+		})
+	}
+	writeJSON(w, http.StatusOK, members)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warningf("Could not write response (%s)", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// failures talking to the agent are a bad gateway, or a gateway timeout if they took too long
+func writeAgentError(w http.ResponseWriter, err error) {
+	if errors.Cause(err) == context.DeadlineExceeded {
+		writeError(w, http.StatusGatewayTimeout, err)
+		return
+	}
+	writeError(w, http.StatusBadGateway, err)
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+}
+
+func serveAPI(c *cli.Context) {
+	profile := headlessProfile(c)
+	if c.Int("history") < 1 {
+		exitWith(ExitUsage, errors.New("--history must be at least 1"))
+	}
+	var opts []core.Option
+	if c.Bool("quiet") {
+		opts = append(opts, core.WithQuietPresence())
+	}
+	ordo := headlessCore(profile, opts...)
+	srv := newAPIServer(ordo, profile.Namespace, c.Duration("timeout"), c.Int("history"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.Duration("timeout"))
+	for _, room := range c.StringSlice("room") {
+		if _, err := srv.join(ctx, room); err != nil {
+			cancel()
+			exitWith(ExitUnavailable, err)
+		}
+	}
+	cancel()
+
+	server := &http.Server{Addr: c.String("http"), Handler: srv.handler()}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	log.Noticef("Serving the bw2chat API on %s", server.Addr)
+	status := 0
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		fmt.Fprintln(os.Stderr, "bw2chat:", errors.Wrap(err, "Could not serve the API"))
+		status = ExitUnavailable
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), ShutdownTimeout)
+	err := ordo.Close(ctx, "")
+	cancel()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "bw2chat:", err)
+	}
+	os.Exit(status)
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gtfierro/ordo/core"
+	"github.com/gtfierro/ordo/core/coretest"
+	"github.com/pkg/errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testNamespace = "test.ns"
+	testRoom      = "test.ns/room/general"
+	testTimeout   = 5 * time.Second
+)
+
+// an API server on a core connected to a fake agent, shut down when the test ends
+func newTestServer(t *testing.T) (*httptest.Server, *coretest.Agent) {
+	t.Helper()
+	agent := coretest.NewAgent("serve-vk")
+	ordo, err := core.New(
+		core.WithEntityFile("test.ent"),
+		core.WithAlias("server"),
+		core.WithTransport(func(addr string) (core.Transport, error) {
+			conn, err := agent.Dial(addr)
+			if err != nil {
+				return nil, err
+			}
+			return conn, nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newAPIServer(ordo, testNamespace, testTimeout, 10)
+	server := httptest.NewServer(srv.handler())
+	t.Cleanup(func() {
+		server.Close()
+		ordo.Close(context.Background(), "")
+	})
+	return server, agent
+}
+
+// makes a request and decodes the JSON response into v, if given
+func request(t *testing.T, server *httptest.Server, method, path, contentType, body string, v interface{}) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contentType) > 0 {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("%s %s: %s", method, path, err)
+		}
+	}
+	return resp
+}
+
+func joinTestRoom(t *testing.T, server *httptest.Server) roomRecord {
+	t.Helper()
+	var room roomRecord
+	if resp := request(t, server, "POST", "/rooms", "application/json", `{"room": "general"}`, &room); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Joining returned %s", resp.Status)
+	}
+	return room
+}
+
+func TestServeRooms(t *testing.T) {
+	server, agent := newTestServer(t)
+	if room := joinTestRoom(t, server); room.URI != testRoom || room.Members != 1 {
+		t.Errorf("Joined %+v, want %s with 1 member", room, testRoom)
+	}
+
+	agent.Inject(testRoom, "other-vk", core.JoinRoom{Alias: "other"}.ToBW())
+	deadline := time.Now().Add(testTimeout)
+	for {
+		var rooms []roomRecord
+		request(t, server, "GET", "/rooms", "", "", &rooms)
+		var members []memberRecord
+		request(t, server, "GET", "/members?room=general", "", "", &members)
+		if len(rooms) == 1 && rooms[0].Members == 2 && len(members) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Listed %+v with members %+v, want general with 2 members", rooms, members)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if resp := request(t, server, "DELETE", "/rooms?room=general&reason=done", "", "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Leaving returned %s", resp.Status)
+	}
+	var rooms []roomRecord
+	request(t, server, "GET", "/rooms", "", "", &rooms)
+	if len(rooms) != 0 {
+		t.Errorf("Listed %+v after leaving", rooms)
+	}
+	if resp := request(t, server, "GET", "/members?room=general", "", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Members of a left room returned %s", resp.Status)
+	}
+}
+
+func TestServeMessages(t *testing.T) {
+	server, agent := newTestServer(t)
+	joinTestRoom(t, server)
+
+	if resp := request(t, server, "POST", "/messages?room=general", "text/plain", "hello\n", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Posting text returned %s", resp.Status)
+	}
+	if resp := request(t, server, "POST", "/messages?room=general", "application/json", `{"message": "again"}`, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Posting JSON returned %s", resp.Status)
+	}
+	published := 0
+	for _, params := range agent.Published(testRoom) {
+		for _, po := range params.PayloadObjects {
+			if po.GetPONum() == core.ChatMessagePID {
+				published++
+			}
+		}
+	}
+	if published != 2 {
+		t.Errorf("%d chat messages published, want 2", published)
+	}
+
+	var messages []tailRecord
+	deadline := time.Now().Add(testTimeout)
+	for len(messages) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("History holds %+v, want both messages", messages)
+		}
+		time.Sleep(10 * time.Millisecond)
+		request(t, server, "GET", "/messages?room=general", "", "", &messages)
+	}
+	if messages[0].Message != "hello" || messages[1].Message != "again" {
+		t.Errorf("History holds %q and %q, want hello and again", messages[0].Message, messages[1].Message)
+	}
+	var latest []tailRecord
+	request(t, server, "GET", fmt.Sprintf("/messages?room=general&since=%d", messages[0].Clock), "", "", &latest)
+	if len(latest) != 1 || latest[0].Message != "again" {
+		t.Errorf("Since the first message got %+v, want only again", latest)
+	}
+}
+
+func TestServeErrors(t *testing.T) {
+	server, agent := newTestServer(t)
+	joinTestRoom(t, server)
+
+	for _, test := range []struct {
+		method, path, contentType, body string
+		status                          int
+	}{
+		{"POST", "/rooms", "application/json", `{"room": ""}`, http.StatusBadRequest},
+		{"POST", "/rooms", "application/json", `not json`, http.StatusBadRequest},
+		{"PUT", "/rooms", "", "", http.StatusMethodNotAllowed},
+		{"DELETE", "/rooms", "", "", http.StatusBadRequest},
+		{"DELETE", "/rooms?room=elsewhere", "", "", http.StatusNotFound},
+		{"GET", "/messages", "", "", http.StatusBadRequest},
+		{"GET", "/messages?room=elsewhere", "", "", http.StatusNotFound},
+		{"GET", "/messages?room=general&since=yesterday", "", "", http.StatusBadRequest},
+		{"GET", "/messages?room=general&limit=-1", "", "", http.StatusBadRequest},
+		{"POST", "/messages", "text/plain", "hello", http.StatusBadRequest},
+		{"POST", "/messages?room=general", "text/plain", " \n", http.StatusBadRequest},
+		{"POST", "/messages?room=general", "application/json", `{"text": "hello"}`, http.StatusBadRequest},
+		{"DELETE", "/messages?room=general", "", "", http.StatusMethodNotAllowed},
+		{"POST", "/members?room=general", "", "", http.StatusMethodNotAllowed},
+	} {
+		var body map[string]string
+		resp := request(t, server, test.method, test.path, test.contentType, test.body, &body)
+		if resp.StatusCode != test.status {
+			t.Errorf("%s %s returned %s, want %d", test.method, test.path, resp.Status, test.status)
+		}
+		if len(body["error"]) == 0 {
+			t.Errorf("%s %s gave no error message", test.method, test.path)
+		}
+		if test.status == http.StatusMethodNotAllowed && len(resp.Header.Get("Allow")) == 0 {
+			t.Errorf("%s %s did not say which methods are allowed", test.method, test.path)
+		}
+	}
+
+	agent.Conn().FailPublishes(errors.New("publish refused"))
+	if resp := request(t, server, "POST", "/messages?room=general", "text/plain", "hello", nil); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Posting with the agent refusing returned %s, want %d", resp.Status, http.StatusBadGateway)
+	}
+}
+
+func TestWriteAgentError(t *testing.T) {
+	for _, test := range []struct {
+		err    error
+		status int
+	}{
+		{errors.New("publish refused"), http.StatusBadGateway},
+		{context.Canceled, http.StatusBadGateway},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout},
+		{errors.Wrap(context.DeadlineExceeded, "Could not publish"), http.StatusGatewayTimeout},
+	} {
+		w := httptest.NewRecorder()
+		writeAgentError(w, test.err)
+		if w.Code != test.status {
+			t.Errorf("%q gave status %d, want %d", test.err, w.Code, test.status)
+		}
+	}
+}
+
+func TestMessageHistory(t *testing.T) {
+	room := &core.Room{URI: testRoom}
+	other := &core.Room{URI: "test.ns/room/other"}
+	history := newMessageHistory(3)
+	for clock := uint64(1); clock <= 5; clock++ {
+		history.add(core.Message{Room: room, Clock: clock, Message: fmt.Sprint(clock)})
+	}
+	history.add(core.Message{Room: other, Clock: 6})
+
+	clocks := func(msgs []core.Message) []uint64 {
+		var found []uint64
+		for _, msg := range msgs {
+			found = append(found, msg.Clock)
+		}
+		return found
+	}
+	for _, test := range []struct {
+		since uint64
+		limit int
+		want  []uint64
+	}{
+		// only the last 3 are kept
+		{0, 0, []uint64{3, 4, 5}},
+		{3, 0, []uint64{4, 5}},
+		{5, 0, nil},
+		{0, 2, []uint64{4, 5}},
+		{3, 1, []uint64{5}},
+		{0, 10, []uint64{3, 4, 5}},
+	} {
+		got := clocks(history.get(testRoom, test.since, test.limit))
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("get(since=%d, limit=%d) = %v, want %v", test.since, test.limit, got, test.want)
+		}
+	}
+	if got := history.get("test.ns/room/unknown", 0, 0); len(got) != 0 {
+		t.Errorf("Unknown room has history %+v", got)
+	}
+}
+
+func TestServeHistoryAfterFailedLeave(t *testing.T) {
+	server, agent := newTestServer(t)
+	joinTestRoom(t, server)
+
+	agent.Conn().FailPublishes(errors.New("publish refused"))
+	if resp := request(t, server, "DELETE", "/rooms?room=general", "", "", nil); resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("Leaving with the agent refusing returned %s, want %d", resp.Status, http.StatusBadGateway)
+	}
+	agent.Conn().FailPublishes(nil)
+	joinTestRoom(t, server)
+
+	agent.Inject(testRoom, "other-vk", core.ChatMessage{Message: "still here", Alias: "other", ID: "1"}.ToBW())
+	deadline := time.Now().Add(testTimeout)
+	for {
+		var messages []tailRecord
+		request(t, server, "GET", "/messages?room=general", "", "", &messages)
+		if len(messages) == 1 && messages[0].Message == "still here" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("History holds %+v after a failed leave, want the new message", messages)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
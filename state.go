@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// what the client remembers between runs
+type SessionState struct {
+	// rooms that were joined when the client last saved its state
+	Joined []string `json:"joined"`
+	// the room being talked in when the client last saved its state
+	LastActive string `json:"last_active"`
+	// rooms managed with \autojoin, joined on every startup
+	Autojoin []string `json:"autojoin"`
+	// rooms where join, leave, nick and topic events are hidden
+	QuietRooms []string `json:"quiet_rooms"`
+}
+
+// SessionStore keeps a SessionState in a file under the XDG state directory.
+// Each profile gets its own file
+type SessionStore struct {
+	sync.Mutex
+	path  string
+	state SessionState
+}
+
+// $XDG_STATE_HOME/bw2chat, or ~/.local/state/bw2chat
+func stateDir() string {
+	base := os.Getenv("XDG_STATE_HOME")
+	if len(base) == 0 {
+		base = filepath.Join(os.Getenv("HOME"), ".local", "state")
+	}
+	return filepath.Join(base, "bw2chat")
+}
+
+// returns the path of a file in the state directory belonging to the given profile
+func statePath(base, profile string) string {
+	name := base + ".json"
+	if len(profile) > 0 {
+		name = fmt.Sprintf("%s-%s.json", base, profile)
+	}
+	return filepath.Join(stateDir(), name)
+}
+
+// where the given profile keeps messages that have not been sent yet
+func OutboxPath(profile string) string {
+	return statePath("outbox", profile)
+}
+
+// opens the state for the given profile, which starts out empty if it has never been saved
+func OpenSessionStore(profile string) (*SessionStore, error) {
+	store := &SessionStore{path: statePath("state", profile)}
+	contents, err := ioutil.ReadFile(store.path)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Could not read state file %s", store.path))
+	}
+	if err := json.Unmarshal(contents, &store.state); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Could not parse state file %s", store.path))
+	}
+	return store, nil
+}
+
+// writes the state to disk, replacing the old file only once the new one is complete
+func (store *SessionStore) Save() error {
+	store.Lock()
+	defer store.Unlock()
+	contents, err := json.MarshalIndent(store.state, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Could not encode state")
+	}
+	if err := os.MkdirAll(filepath.Dir(store.path), 0700); err != nil {
+		return errors.Wrap(err, "Could not create state directory")
+	}
+	tmp := store.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, contents, 0600); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("Could not write state file %s", tmp))
+	}
+	return os.Rename(tmp, store.path)
+}
+
+// records the joined rooms and which one is active
+func (store *SessionStore) SetJoined(rooms []string, lastActive string) {
+	store.Lock()
+	defer store.Unlock()
+	store.state.Joined = rooms
+	store.state.LastActive = lastActive
+}
+
+// returns false if the room was already in the autojoin list
+func (store *SessionStore) AddAutojoin(room string) bool {
+	store.Lock()
+	defer store.Unlock()
+	for _, uri := range store.state.Autojoin {
+		if uri == room {
+			return false
+		}
+	}
+	store.state.Autojoin = append(store.state.Autojoin, room)
+	return true
+}
+
+// returns false if the room was not in the autojoin list
+func (store *SessionStore) RemoveAutojoin(room string) bool {
+	store.Lock()
+	defer store.Unlock()
+	for i, uri := range store.state.Autojoin {
+		if uri == room {
+			store.state.Autojoin = append(store.state.Autojoin[:i], store.state.Autojoin[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// records whether events are hidden in the room
+func (store *SessionStore) SetQuiet(room string, quiet bool) {
+	store.Lock()
+	defer store.Unlock()
+	for i, uri := range store.state.QuietRooms {
+		if uri == room {
+			store.state.QuietRooms = append(store.state.QuietRooms[:i], store.state.QuietRooms[i+1:]...)
+			break
+		}
+	}
+	if quiet {
+		store.state.QuietRooms = append(store.state.QuietRooms, room)
+	}
+}
+
+func (store *SessionStore) QuietRooms() []string {
+	store.Lock()
+	defer store.Unlock()
+	return append([]string{}, store.state.QuietRooms...)
+}
+
+func (store *SessionStore) Autojoin() []string {
+	store.Lock()
+	defer store.Unlock()
+	return append([]string{}, store.state.Autojoin...)
+}
+
+// the rooms to join on startup: the autojoin list and the rooms joined last time,
+// without duplicates, ending with the last active room so that it becomes current
+func (store *SessionStore) StartupRooms(extra []string) []string {
+	store.Lock()
+	defer store.Unlock()
+	var rooms []string
+	seen := make(map[string]bool)
+	add := func(uris ...string) {
+		for _, uri := range uris {
+			if len(uri) > 0 && !seen[uri] && uri != store.state.LastActive {
+				seen[uri] = true
+				rooms = append(rooms, uri)
+			}
+		}
+	}
+	add(extra...)
+	add(store.state.Autojoin...)
+	add(store.state.Joined...)
+	if len(store.state.LastActive) > 0 {
+		rooms = append(rooms, store.state.LastActive)
+	}
+	return rooms
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"github.com/gtfierro/ordo/core"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// chat lines for tail --output plain name the room, since several can be tailed at once
+	DefaultTailFormat       = "{{.Time}} {{.Room}} [{{.From}}]> {{.Message}}"
+	DefaultTailSystemFormat = "{{.Time}} {{.Room}} -!- {{.Message}}"
+	DefaultTailTimeFormat   = "2006-01-02 15:04:05"
+)
+
+// one line of tail output
+type tailRecord struct {
+	Time time.Time `json:"time"`
+	// chat, join, leave, nick or topic
+	Type   string `json:"type"`
+	Room   string `json:"room"`
+	From   string `json:"from,omitempty"`
+	FromVK string `json:"from_vk,omitempty"`
+	// the chat message, or a description of the event
+	Message string `json:"message"`
+	// why someone left
+	Reason string `json:"reason,omitempty"`
+	ID     string `json:"id,omitempty"`
+	// hybrid logical clock of chat messages, for ordering
+	Clock   uint64 `json:"clock,omitempty"`
+	Mention bool   `json:"mention,omitempty"`
+
+	room *core.Room
+	kind core.MessageKind
+}
+
+// returns the record for ev, if it is something tail prints
+func newTailRecord(ev core.Event) (tailRecord, bool) {
+	now := time.Now()
+	switch ev := ev.(type) {
+	case core.ChatReceived:
+		msg := ev.Message
+		return tailRecord{Time: msg.Time, Room: msg.Room.URI, From: msg.From, FromVK: msg.FromVK, Message: msg.Message,
+			ID: msg.ID, Clock: msg.Clock, Mention: msg.Mention, room: msg.Room, kind: core.ChatKind}, true
+	case core.MemberJoined:
+		return tailRecord{Time: now, Room: ev.Room.URI, From: ev.Member.Alias, FromVK: ev.Member.VK, Message: ev.String(),
+			room: ev.Room, kind: core.JoinKind}, true
+	case core.MemberLeft:
+		return tailRecord{Time: now, Room: ev.Room.URI, From: ev.Member.Alias, FromVK: ev.Member.VK, Message: ev.String(),
+			Reason: ev.Reason, room: ev.Room, kind: core.LeaveKind}, true
+	case core.MemberRenamed:
+		return tailRecord{Time: now, Room: ev.Room.URI, From: ev.Member.Alias, FromVK: ev.Member.VK, Message: ev.String(),
+			room: ev.Room, kind: core.NickKind}, true
+	case core.TopicChanged:
+		return tailRecord{Time: now, Room: ev.Room.URI, From: ev.By, Message: ev.String(),
+			room: ev.Room, kind: core.TopicKind}, true
+	}
+	return tailRecord{}, false
+}
+
+// writes tail records in one of the output formats
+type tailWriter func(rec tailRecord) error
+
+// plain output uses the given formats rather than the profile's, which are meant
+// for the terminal interface
+func newTailWriter(output, format, systemFormat, timeFormat string, w io.Writer) (tailWriter, error) {
+	switch output {
+	case "json":
+		enc := json.NewEncoder(w)
+		return func(rec tailRecord) error {
+			rec.Type = rec.kind.String()
+			return enc.Encode(rec)
+		}, nil
+	case "logfmt":
+		return func(rec tailRecord) error {
+			_, err := io.WriteString(w, logfmtLine(rec))
+			return err
+		}, nil
+	case "plain":
+		theme, err := LoadTheme("mono")
+		if err != nil {
+			return nil, err
+		}
+		renderer, err := NewRenderer(format, systemFormat, timeFormat, theme)
+		if err != nil {
+			return nil, err
+		}
+		return func(rec tailRecord) error {
+			lines := renderer.Render(core.Message{
+				Kind:    rec.kind,
+				Message: rec.Message,
+				FromVK:  rec.FromVK,
+				From:    rec.From,
+				Room:    rec.room,
+				ID:      rec.ID,
+				Time:    rec.Time,
+			})
+			_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+			return err
+		}, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown output format %s (json, plain or logfmt)", output))
+	}
+}
+
+// formats rec as key=value pairs, quoting values that need it
+func logfmtLine(rec tailRecord) string {
+	pairs := []string{
+		"time=" + rec.Time.Format(time.RFC3339Nano),
+		"type=" + rec.kind.String(),
+		"room=" + logfmtValue(rec.Room),
+	}
+	add := func(key, value string) {
+		if len(value) > 0 {
+			pairs = append(pairs, key+"="+logfmtValue(value))
+		}
+	}
+	add("from", rec.From)
+	add("from_vk", rec.FromVK)
+	add("id", rec.ID)
+	if rec.Mention {
+		pairs = append(pairs, "mention=true")
+	}
+	pairs = append(pairs, "message="+logfmtValue(rec.Message))
+	add("reason", rec.Reason)
+	return strings.Join(pairs, " ") + "\n"
+}
+
+func logfmtValue(value string) string {
+	if len(value) == 0 || strings.ContainsAny(value, " =\"\\") || strconv.Quote(value) != `"`+value+`"` {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+func tailRooms(c *cli.Context) {
+	profile := headlessProfile(c)
+	uris := headlessRooms(profile, c.StringSlice("room"))
+	write, err := newTailWriter(c.String("output"), c.String("format"), c.String("system-format"), c.String("time-format"), os.Stdout)
+	if err != nil {
+		exitWith(ExitUsage, err)
+	}
+	var opts []core.Option
+	if c.Bool("quiet") {
+		opts = append(opts, core.WithQuietPresence())
+	}
+	ordo := headlessCore(profile, opts...)
+
+	// subscribe before joining so nothing is missed. Block rather than drop: if
+	// we cannot keep up, the rooms wait for us
+	sub := ordo.Subscribe(1000, core.Block)
+	ctx, cancel := context.WithTimeout(context.Background(), c.Duration("timeout"))
+	for _, uri := range uris {
+		if _, err := ordo.JoinRoom(ctx, uri); err != nil {
+			cancel()
+			exitWith(ExitUnavailable, errors.Wrap(err, fmt.Sprintf("Could not join %s", uri)))
+		}
+	}
+	cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	status := 0
+loop:
+	for {
+		select {
+		case <-signals:
+			break loop
+		case ev := <-sub.C:
+			// errors and connection changes are logged to stderr by the core
+			rec, ok := newTailRecord(ev)
+			if !ok {
+				continue
+			}
+			if err := write(rec); err != nil {
+				fmt.Fprintln(os.Stderr, "bw2chat:", errors.Wrap(err, "Could not write output"))
+				status = ExitIOErr
+				break loop
+			}
+		}
+	}
+
+	sub.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), ShutdownTimeout)
+	err = ordo.Close(ctx, "")
+	cancel()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "bw2chat:", err)
+	}
+	os.Exit(status)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gtfierro/ordo/core"
+	"testing"
+	"time"
+)
+
+func TestLogfmtValue(t *testing.T) {
+	for _, test := range []struct {
+		value, want string
+	}{
+		{"plain", "plain"},
+		{"héllo", "héllo"},
+		{"", `""`},
+		{"two words", `"two words"`},
+		{"a=b", `"a=b"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{`back\slash`, `"back\\slash"`},
+		{"line\nbreak", `"line\nbreak"`},
+		{"tab\there", `"tab\there"`},
+		{"bell\a", `"bell\a"`},
+	} {
+		if got := logfmtValue(test.value); got != test.want {
+			t.Errorf("logfmtValue(%q) = %s, want %s", test.value, got, test.want)
+		}
+	}
+}
+
+func TestLogfmtLine(t *testing.T) {
+	when := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, test := range []struct {
+		rec  tailRecord
+		want string
+	}{
+		{tailRecord{Time: when, Room: "ns/room/general", From: "bob", FromVK: "vk=", ID: "abc", Mention: true,
+			Message: "hi alice", kind: core.ChatKind},
+			`time=2016-01-02T03:04:05Z type=chat room=ns/room/general from=bob from_vk="vk=" id=abc mention=true message="hi alice"` + "\n"},
+		{tailRecord{Time: when, Room: "ns/room/general", From: "bob", Message: "bob left (gone home)", Reason: "gone home",
+			kind: core.LeaveKind},
+			`time=2016-01-02T03:04:05Z type=leave room=ns/room/general from=bob message="bob left (gone home)" reason="gone home"` + "\n"},
+		// empty fields are left out, except for the message
+		{tailRecord{Time: when, Room: "ns/room/general", kind: core.TopicKind},
+			`time=2016-01-02T03:04:05Z type=topic room=ns/room/general message=""` + "\n"},
+	} {
+		if got := logfmtLine(test.rec); got != test.want {
+			t.Errorf("logfmtLine gave\n%s want\n%s", got, test.want)
+		}
+	}
+}
+
+func TestNewTailRecord(t *testing.T) {
+	room := &core.Room{URI: "ns/room/general", Name: "/general"}
+	bob := core.Member{VK: "bob-vk", Alias: "bob"}
+	sent := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, test := range []struct {
+		ev   core.Event
+		want tailRecord
+	}{
+		{core.ChatReceived{Message: core.Message{Kind: core.ChatKind, Room: room, From: "bob", FromVK: "bob-vk",
+			Message: "hello", ID: "abc", Clock: 42, Time: sent, Mention: true}},
+			tailRecord{Time: sent, Room: room.URI, From: "bob", FromVK: "bob-vk", Message: "hello", ID: "abc", Clock: 42,
+				Mention: true, kind: core.ChatKind}},
+		{core.MemberJoined{Room: room, Member: bob},
+			tailRecord{Room: room.URI, From: "bob", FromVK: "bob-vk", Message: "bob joined", kind: core.JoinKind}},
+		{core.MemberLeft{Room: room, Member: bob, Reason: "lunch"},
+			tailRecord{Room: room.URI, From: "bob", FromVK: "bob-vk", Message: "bob left (lunch)", Reason: "lunch",
+				kind: core.LeaveKind}},
+		{core.MemberRenamed{Room: room, Member: bob, OldAlias: "robert"},
+			tailRecord{Room: room.URI, From: "bob", FromVK: "bob-vk", Message: "robert is now known as bob",
+				kind: core.NickKind}},
+		{core.TopicChanged{Room: room, Topic: "deploys", By: "bob"},
+			tailRecord{Room: room.URI, From: "bob", Message: "bob set the topic to: deploys", kind: core.TopicKind}},
+	} {
+		got, ok := newTailRecord(test.ev)
+		if !ok {
+			t.Errorf("No record for %T", test.ev)
+			continue
+		}
+		if got.room != room {
+			t.Errorf("%T: record not linked to its room", test.ev)
+		}
+		if test.want.Time.IsZero() {
+			// events are stamped when tail sees them
+			if time.Since(got.Time) > time.Minute {
+				t.Errorf("%T: stamped %s", test.ev, got.Time)
+			}
+			got.Time = time.Time{}
+		}
+		got.room = nil
+		if got != test.want {
+			t.Errorf("%T: record\n%+v want\n%+v", test.ev, got, test.want)
+		}
+	}
+
+	for _, ev := range []core.Event{
+		core.ConnectionChanged{Connected: true},
+		core.RoomStateChanged{},
+		core.OutboundChanged{},
+	} {
+		if rec, ok := newTailRecord(ev); ok {
+			t.Errorf("%T gave record %+v", ev, rec)
+		}
+	}
+}
+
+func TestTailWriter(t *testing.T) {
+	room := &core.Room{URI: "ns/room/general", Name: "/general"}
+	rec, _ := newTailRecord(core.ChatReceived{Message: core.Message{Kind: core.ChatKind, Room: room, From: "bob",
+		Message: "hello", Time: time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)}})
+
+	var buf bytes.Buffer
+	write, err := newTailWriter("json", "", "", "", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := write(rec); err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded["type"] != "chat" || decoded["message"] != "hello" || decoded["room"] != room.URI {
+		t.Errorf("Wrote %s", buf.String())
+	}
+
+	buf.Reset()
+	write, err = newTailWriter("plain", "{{.Time}} <{{.From}}> {{.Message}}", DefaultTailSystemFormat, "15:04", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := write(rec); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != "03:04 <bob> hello\n" {
+		t.Errorf("Wrote %q with the given format", got)
+	}
+
+	if _, err := newTailWriter("yaml", "", "", "", &buf); err == nil {
+		t.Error("Accepted an unknown output format")
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/jroimartin/gocui"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// print functions for client-generated text. Set by ApplyTheme
+var (
+	printError   = color.New(color.FgRed).SprintFunc()
+	printInfo    = color.New(color.FgYellow).SprintFunc()
+	printSuccess = color.New(color.FgGreen).SprintFunc()
+	printMention = color.New(color.FgMagenta, color.Bold).SprintFunc()
+)
+
+// Theme controls the colors of the interface. Each field is a space separated list
+// of a color (black, red, green, yellow, blue, magenta, cyan, white, default) and
+// attributes (bold, underline, reverse), e.g. "bold cyan".
+// An empty OtherMessage colors each nick by hashing the sender's VK
+type Theme struct {
+	Sidebar      string `json:"sidebar"`
+	Header       string `json:"header"`
+	OwnMessage   string `json:"own_message"`
+	OtherMessage string `json:"other_message"`
+	Mention      string `json:"mention"`
+	System       string `json:"system"`
+	Error        string `json:"error"`
+	Success      string `json:"success"`
+	// disables all colors
+	Monochrome bool `json:"monochrome"`
+}
+
+var BuiltinThemes = map[string]Theme{
+	"default": {
+		Sidebar:    "default",
+		Header:     "bold",
+		OwnMessage: "bold",
+		Mention:    "bold magenta",
+		System:     "yellow",
+		Error:      "red",
+		Success:    "green",
+	},
+	"dark": {
+		Sidebar:    "cyan",
+		Header:     "bold white",
+		OwnMessage: "bold white",
+		Mention:    "bold yellow",
+		System:     "blue",
+		Error:      "bold red",
+		Success:    "bold green",
+	},
+	"light": {
+		Sidebar:      "blue",
+		Header:       "bold black",
+		OwnMessage:   "bold black",
+		OtherMessage: "blue",
+		Mention:      "bold red",
+		System:       "magenta",
+		Error:        "red",
+		Success:      "green",
+	},
+	"mono": {
+		Monochrome: true,
+	},
+}
+
+// loads a built-in theme by name, or a JSON theme file by path. Fields missing
+// from the file fall back to the default theme. If NO_COLOR is set to anything
+// but the empty string, the monochrome theme is always used (https://no-color.org)
+func LoadTheme(nameOrPath string) (*Theme, error) {
+	if os.Getenv("NO_COLOR") != "" {
+		theme := BuiltinThemes["mono"]
+		return &theme, nil
+	}
+	if theme, found := BuiltinThemes[nameOrPath]; found {
+		return &theme, nil
+	}
+	contents, err := ioutil.ReadFile(nameOrPath)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("No built-in theme or theme file named %s", nameOrPath))
+	}
+	theme := BuiltinThemes["default"]
+	if err := json.Unmarshal(contents, &theme); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Could not parse theme file %s", nameOrPath))
+	}
+	for _, spec := range []string{theme.Sidebar, theme.Header, theme.OwnMessage, theme.OtherMessage, theme.Mention, theme.System, theme.Error, theme.Success} {
+		if _, _, err := parseColorSpec(spec); err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("Invalid color in theme file %s", nameOrPath))
+		}
+	}
+	return &theme, nil
+}
+
+// sets the print functions used for client-generated text
+func (t *Theme) Apply() {
+	color.NoColor = t.Monochrome
+	printError = t.Color(t.Error).SprintFunc()
+	printInfo = t.Color(t.System).SprintFunc()
+	printSuccess = t.Color(t.Success).SprintFunc()
+	printMention = t.Color(t.Mention).SprintFunc()
+}
+
+// returns the text color for a spec, or a plain color if the theme is monochrome
+func (t *Theme) Color(spec string) *color.Color {
+	c, _, err := parseColorSpec(spec)
+	if err != nil || t.Monochrome {
+		return color.New(color.Reset)
+	}
+	return c
+}
+
+// returns the gocui attribute for a spec, for coloring views
+func (t *Theme) ViewColor(spec string) gocui.Attribute {
+	_, attr, err := parseColorSpec(spec)
+	if err != nil || t.Monochrome {
+		return gocui.ColorDefault
+	}
+	return attr
+}
+
+func parseColorSpec(spec string) (*color.Color, gocui.Attribute, error) {
+	c := color.New()
+	attr := gocui.ColorDefault
+	for _, word := range strings.Fields(strings.ToLower(spec)) {
+		switch word {
+		case "default":
+		case "black":
+			c.Add(color.FgBlack)
+			attr |= gocui.ColorBlack
+		case "red":
+			c.Add(color.FgRed)
+			attr |= gocui.ColorRed
+		case "green":
+			c.Add(color.FgGreen)
+			attr |= gocui.ColorGreen
+		case "yellow":
+			c.Add(color.FgYellow)
+			attr |= gocui.ColorYellow
+		case "blue":
+			c.Add(color.FgBlue)
+			attr |= gocui.ColorBlue
+		case "magenta":
+			c.Add(color.FgMagenta)
+			attr |= gocui.ColorMagenta
+		case "cyan":
+			c.Add(color.FgCyan)
+			attr |= gocui.ColorCyan
+		case "white":
+			c.Add(color.FgWhite)
+			attr |= gocui.ColorWhite
+		case "bold":
+			c.Add(color.Bold)
+			attr |= gocui.AttrBold
+		case "underline":
+			c.Add(color.Underline)
+			attr |= gocui.AttrUnderline
+		case "reverse":
+			c.Add(color.ReverseVideo)
+			attr |= gocui.AttrReverse
+		default:
+			return nil, gocui.ColorDefault, errors.New(fmt.Sprintf("Unknown color or attribute %s", word))
+		}
+	}
+	return c, attr, nil
+}
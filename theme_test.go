@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLoadThemeNoColor(t *testing.T) {
+	for _, test := range []struct {
+		value      string
+		monochrome bool
+	}{
+		{"", false},
+		{"1", true},
+		{"false", true},
+	} {
+		t.Setenv("NO_COLOR", test.value)
+		theme, err := LoadTheme("default")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if theme.Monochrome != test.monochrome {
+			t.Errorf("NO_COLOR=%q gave monochrome %t, want %t", test.value, theme.Monochrome, test.monochrome)
+		}
+	}
+}